@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Used by `Opt.TestAffected`. Rewrites the package arguments of "go test" to
+only the packages affected by the changed paths: packages containing the
+changes, and packages which import them, directly or transitively. Only
+packages matched by the original arguments are considered.
+
+Returns false when the full command should be run instead: when the command is
+not "go test", when a changed path doesn't belong to any known package (for
+example "go.mod"), or when the packages can't be listed. Packages are listed
+via `Opt.Cmd`. Errors are logged via `Opt.Logger`, which is prefixed with the
+task name.
+*/
+func AffectedTestArgs(opt Opt, paths []string) ([]string, bool) {
+	args := ParseGoArgs(opt.Args)
+	if args.Sub != `test` || gg.IsEmpty(paths) {
+		return nil, false
+	}
+
+	pkgs, err := GoList(opt.Cmd, gg.Concat(args.ListFlags(), args.PkgsOrDefault())...)
+	if err != nil {
+		opt.Logger().Println(`unable to determine affected packages:`, err)
+		return nil, false
+	}
+
+	affected, ok := affectedPkgs(pkgs, paths)
+	if !ok || gg.IsEmpty(affected) {
+		return nil, false
+	}
+
+	args.Pkgs = affected
+	return args.Args(), true
+}
+
+// Returns sorted import paths of affected packages. See `AffectedTestArgs`.
+func affectedPkgs(pkgs []GoPkg, paths []string) ([]string, bool) {
+	dirToPkgs := map[string][]string{}
+	importers := map[string][]string{}
+
+	for _, pkg := range pkgs {
+		dirToPkgs[pkg.Dir] = append(dirToPkgs[pkg.Dir], pkg.ImportPath)
+	}
+	for _, pkg := range pkgs {
+		for _, val := range pkg.AllImports() {
+			if val != pkg.ImportPath {
+				importers[val] = append(importers[val], pkg.ImportPath)
+			}
+		}
+	}
+
+	found := gg.Set[string]{}
+	var queue []string
+
+	for _, path := range paths {
+		if isGoModFile(path) || filepath.Base(path) == `go.sum` {
+			return nil, false
+		}
+
+		dir, ok := nearestPkgDir(dirToPkgs, filepath.Dir(path))
+		if !ok {
+			return nil, false
+		}
+		queue = append(queue, dirToPkgs[dir]...)
+	}
+
+	for len(queue) > 0 {
+		head := queue[0]
+		queue = queue[1:]
+		if found.Has(head) {
+			continue
+		}
+		found.Add(head)
+		queue = append(queue, importers[head]...)
+	}
+
+	out := found.Slice()
+	gg.SortPrim(out)
+	return out, true
+}
+
+/*
+Files such as "testdata/some.json" affect the package of the closest ancestor
+directory.
+*/
+func nearestPkgDir(dirToPkgs map[string][]string, dir string) (string, bool) {
+	for {
+		if gg.MapHas(dirToPkgs, dir) {
+			return dir, true
+		}
+		next := filepath.Dir(dir)
+		if next == dir {
+			return ``, false
+		}
+		dir = next
+	}
+}
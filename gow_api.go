@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Optional control server, enabled via `Opt.Api`. Allows editor save hooks and
+other tools to drive `gow` without hotkeys, and without sending signals to
+`gow` itself, which would kill it. Endpoints:
+
+	POST /restart          restart, like ^R
+	POST /stop             stop the subprocess like `Cmd.Stop`, without restarting; responds once stopped
+	POST /signal/{name}    send a signal to the subprocess, like ^C; for example "/signal/SIGHUP"
+	POST /pause            pause watching, like ^P; the subprocess keeps running
+	POST /resume           resume watching; see `Main.SetPaused`
+	GET  /status           JSON: pids, uptime, paused, last exit, last changed file
+
+Requests from browsers are rejected; see `Api.Guard`.
+
+By default, all endpoints apply to all tasks. Pausing always applies to all
+tasks, since they share the watcher. For other endpoints, the query parameter
+"task" selects one named task. See `Task`.
+*/
+type Api struct {
+	Mained
+	Listener net.Listener
+	Server   http.Server
+	Started  time.Time
+}
+
+/*
+Supported addresses:
+
+	<path>         unix socket, for example "gow.sock"
+	unix:<path>    same as above
+	tcp:<addr>     TCP on a loopback interface, for example "tcp:localhost:7070"
+
+The API can restart and signal processes, so TCP is limited to loopback
+addresses; see `loopbackAddr`.
+*/
+func (self *Api) Init(main *Main) {
+	self.Mained.Init(main)
+	self.Started = time.Now()
+
+	src := main.Opt.Api
+	if src == `` {
+		return
+	}
+
+	lis, err := listenApi(src)
+	if err != nil {
+		panic(gg.Wrapf(err, `unable to start control API on %q`, src))
+	}
+	self.Listener = lis
+	self.Server.Handler = self.Handler()
+
+	if main.IsVerb() {
+		log.Printf(`control API listening on %q`, lis.Addr())
+	}
+}
+
+/*
+Closing a unix listener also removes its socket file. `.Listener` stays set,
+since handlers may still be running and reading it; see `Api.IsTcp`.
+*/
+func (self *Api) Deinit() {
+	if self.Listener != nil {
+		gg.Nop1(self.Server.Close())
+	}
+}
+
+func (self *Api) IsActive() bool { return self.Listener != nil }
+
+func (self *Api) Run() {
+	err := self.Server.Serve(self.Listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println(`control API error:`, err)
+	}
+}
+
+func (self *Api) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`POST /restart`, self.OnRestart)
+	mux.HandleFunc(`POST /stop`, self.OnStop)
+	mux.HandleFunc(`POST /signal/{name}`, self.OnSignal)
+	mux.HandleFunc(`POST /pause`, self.OnPause)
+	mux.HandleFunc(`POST /resume`, self.OnResume)
+	mux.HandleFunc(`GET /status`, self.OnStatus)
+	return self.Guard(mux)
+}
+
+/*
+Listening on a loopback address doesn't protect the API from browsers. Any
+website can send requests to localhost, and with DNS rebinding, can also read
+the responses. Browsers include the "Origin" header in such requests, and with
+DNS rebinding, the "Host" header has the attacker's domain. Requests with
+either are rejected. Over a unix socket, "Host" is arbitrary, and is not
+checked.
+*/
+func (self *Api) Guard(han http.Handler) http.Handler {
+	return http.HandlerFunc(func(rew http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(`Origin`) != `` {
+			http.Error(rew, `requests from browsers are not allowed`, http.StatusForbidden)
+			return
+		}
+		if self.IsTcp() && !isLoopbackHost(hostWithoutPort(req.Host)) {
+			http.Error(rew, `unexpected host `+req.Host, http.StatusForbidden)
+			return
+		}
+		han.ServeHTTP(rew, req)
+	})
+}
+
+func (self *Api) IsTcp() bool {
+	_, ok := self.Listener.(*net.TCPListener)
+	return ok
+}
+
+func hostWithoutPort(src string) string {
+	host, _, err := net.SplitHostPort(src)
+	if err != nil {
+		return src
+	}
+	return host
+}
+
+func (self *Api) OnRestart(rew http.ResponseWriter, req *http.Request) {
+	tasks, ok := self.Tasks(rew, req)
+	if !ok {
+		return
+	}
+	self.logReq(req)
+	for _, task := range tasks {
+		task.Restart()
+	}
+	rew.WriteHeader(http.StatusAccepted)
+}
+
+func (self *Api) OnStop(rew http.ResponseWriter, req *http.Request) {
+	tasks, ok := self.Tasks(rew, req)
+	if !ok {
+		return
+	}
+	self.logReq(req)
+
+	// Like when restarting: waits up to `Opt.StopWait`, then uses SIGKILL.
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task.Cmd.Stop(task.Opt.StopSig.Signal())
+		}()
+	}
+	wg.Wait()
+	rew.WriteHeader(http.StatusOK)
+}
+
+func (self *Api) OnSignal(rew http.ResponseWriter, req *http.Request) {
+	sig, err := parseSignal(req.PathValue(`name`))
+	if err != nil {
+		http.Error(rew, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tasks, ok := self.Tasks(rew, req)
+	if !ok {
+		return
+	}
+	self.logReq(req)
+	for _, task := range tasks {
+		task.Cmd.Interrupt(sig)
+	}
+	rew.WriteHeader(http.StatusAccepted)
+}
+
+func (self *Api) OnPause(rew http.ResponseWriter, req *http.Request) {
+	self.logReq(req)
+	self.Main().SetPaused(true)
+	rew.WriteHeader(http.StatusAccepted)
+}
+
+func (self *Api) OnResume(rew http.ResponseWriter, req *http.Request) {
+	self.logReq(req)
+	self.Main().SetPaused(false)
+	rew.WriteHeader(http.StatusAccepted)
+}
+
+func (self *Api) OnStatus(rew http.ResponseWriter, req *http.Request) {
+	tasks, ok := self.Tasks(rew, req)
+	if !ok {
+		return
+	}
+
+	out := ApiStatus{
+		Pid:    os.Getpid(),
+		Uptime: time.Since(self.Started).Milliseconds(),
+		Paused: self.Main().Paused.Load(),
+		Tasks:  gg.Map(tasks, (*Task).ApiStatus),
+	}
+	rew.Header().Set(`Content-Type`, `application/json`)
+	gg.Nop2(rew.Write(gg.JsonBytes(out)))
+}
+
+/*
+Tasks selected by the query parameter "task", or all tasks. Responds with 404
+if there's no such task.
+*/
+func (self *Api) Tasks(rew http.ResponseWriter, req *http.Request) ([]*Task, bool) {
+	tasks := self.Main().Tasks
+	name := req.URL.Query().Get(`task`)
+	if name == `` {
+		return tasks, true
+	}
+
+	out := gg.Filter(tasks, func(task *Task) bool { return task.Name == name })
+	if gg.IsEmpty(out) {
+		http.Error(rew, `unknown task `+name, http.StatusNotFound)
+		return nil, false
+	}
+	return out, true
+}
+
+func (self *Api) logReq(req *http.Request) {
+	if self.Main().IsVerb() {
+		log.Printf(`received API request %v %v`, req.Method, req.URL)
+	}
+}
+
+type ApiStatus struct {
+	Pid    int             `json:"pid"`
+	Uptime int64           `json:"uptime_ms"`
+	Paused bool            `json:"paused"`
+	Tasks  []ApiTaskStatus `json:"tasks"`
+}
+
+type ApiTaskStatus struct {
+	Name     string   `json:"name,omitempty"`
+	Args     []string `json:"args"`
+	Running  bool     `json:"running"`
+	Pid      int      `json:"pid,omitempty"`
+	Pids     []int    `json:"pids,omitempty"`
+	Uptime   int64    `json:"uptime_ms,omitempty"`
+	LastExit *Event   `json:"last_exit,omitempty"`
+	LastPath string   `json:"last_path,omitempty"`
+}
+
+/*
+Recorded by `Task.Emit` regardless of whether the event stream is enabled.
+Used by `Api`.
+*/
+type TaskStatus struct {
+	Lock     sync.Mutex
+	Started  time.Time
+	LastExit *Event
+	LastPath string
+}
+
+func (self *TaskStatus) OnEvent(val Event) {
+	defer gg.Lock(&self.Lock).Unlock()
+
+	switch val.Type {
+	case EventTypeStart:
+		self.Started = val.Time
+	case EventTypeExit:
+		self.LastExit = &val
+	case EventTypeFsEvent:
+		self.LastPath = val.Path
+	}
+}
+
+func (self *Task) ApiStatus() (out ApiTaskStatus) {
+	out.Name = self.Name
+	out.Args = gg.Concat([]string{self.Opt.Cmd}, self.Opt.Args)
+	out.Pid = int(self.Cmd.Pid.Load())
+	out.Running = out.Pid != 0
+
+	if out.Running {
+		out.Pids, _ = SubPids(out.Pid, false)
+	}
+
+	defer gg.Lock(&self.Status.Lock).Unlock()
+	if out.Running && !self.Status.Started.IsZero() {
+		out.Uptime = time.Since(self.Status.Started).Milliseconds()
+	}
+	out.LastExit = self.Status.LastExit
+	out.LastPath = self.Status.LastPath
+	return
+}
+
+func listenApi(src string) (net.Listener, error) {
+	if strings.HasPrefix(src, `tcp:`) {
+		addr, err := loopbackAddr(strings.TrimPrefix(src, `tcp:`))
+		if err != nil {
+			return nil, err
+		}
+		return net.Listen(`tcp`, addr)
+	}
+
+	path := strings.TrimPrefix(src, `unix:`)
+	lis, err := net.Listen(`unix`, path)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return lis, err
+	}
+
+	/**
+	The socket file may be left over from a previous `gow` which didn't exit
+	cleanly. If nobody is listening, the file is stale, and we replace it.
+	*/
+	conn, dialErr := net.Dial(`unix`, path)
+	if dialErr == nil {
+		gg.Nop1(conn.Close())
+		return nil, gg.Wrap(err, `another process is already listening`)
+	}
+	info, statErr := os.Lstat(path)
+	if statErr != nil {
+		return nil, statErr
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil, gg.Wrapf(err, `refusing to replace %q which is not a socket`, path)
+	}
+	gg.Nop1(os.Remove(path))
+	return net.Listen(`unix`, path)
+}
+
+/*
+Used for servers which must be reachable only from the local machine. A missing
+host means "127.0.0.1".
+*/
+func loopbackAddr(src string) (string, error) {
+	host, port, err := net.SplitHostPort(src)
+	if err != nil {
+		return ``, err
+	}
+	if host == `` {
+		host = `127.0.0.1`
+	}
+	if !isLoopbackHost(host) {
+		return ``, gg.Errf(`host %q is not a loopback address; only localhost is supported`, host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, `localhost`) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
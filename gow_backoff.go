@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Crash-loop detection. Tracks recent failures of the subprocess. When the
+subprocess fails `Opt.BackoffFails` times within `Opt.BackoffWindow`,
+automatic restarts are delayed, starting with `Opt.BackoffDelay` and doubling
+with each further failure, up to `Opt.BackoffMax`. A successful exit resets
+the state. Manual restarts are never delayed; see `Task.RestartDelay`.
+
+Only failures of the current subprocess are recorded. Exits caused by our own
+restarts don't count; see `Cmd.Gen`.
+*/
+type Backoff struct {
+	Lock  sync.Mutex
+	Fails []time.Time
+}
+
+func (self *Backoff) OnExit(err error, inst time.Time) {
+	defer gg.Lock(&self.Lock).Unlock()
+	if err == nil {
+		self.Fails = nil
+	} else {
+		self.Fails = append(self.Fails, inst)
+	}
+}
+
+// Returns the delay for the next automatic restart, if any.
+func (self *Backoff) Delay(opt Opt, now time.Time) time.Duration {
+	if opt.BackoffFails <= 0 {
+		return 0
+	}
+
+	defer gg.Lock(&self.Lock).Unlock()
+
+	since := now.Add(-opt.BackoffWindow.Duration())
+	self.Fails = gg.Filter(self.Fails, func(val time.Time) bool { return val.After(since) })
+
+	extra := len(self.Fails) - opt.BackoffFails
+	if extra < 0 {
+		return 0
+	}
+	return backoffDelay(opt.BackoffDelay.Duration(), opt.BackoffMax.Duration(), extra)
+}
+
+func backoffDelay(base, limit time.Duration, exp int) time.Duration {
+	out := base
+	for ; exp > 0 && (limit <= 0 || out < limit); exp-- {
+		out *= 2
+	}
+	if limit > 0 && out > limit {
+		return limit
+	}
+	return out
+}
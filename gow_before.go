@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+In-flight pipeline of steps, which runs in the background before the main
+command. Running in the background allows the restart loop to receive new FS
+events, which cancel the pipeline and start over. See `Cmd.RunSteps`.
+*/
+type Before struct {
+	Cancel context.CancelFunc
+	Done   gg.Chan[struct{}]
+}
+
+// One step of the pipeline. See `Cmd.Steps`.
+type Step struct {
+	Desc string
+	Args []string
+}
+
+/*
+Steps which must succeed before starting the main command: `Opt.Before`, each
+via "sh -c", followed by the build in build mode; see `Opt.Build`.
+*/
+func (self *Cmd) Steps(args []string) (out []Step) {
+	opt := self.Task().Opt
+	for _, val := range opt.Before {
+		out = append(out, Step{Desc: val, Args: []string{`sh`, `-c`, val}})
+	}
+	if opt.Build {
+		out = append(out, self.BuildStep(args))
+	}
+	return
+}
+
+/*
+Starts the steps in the background, then the main command. Steps run in order.
+When a step fails, the run is aborted: the main command doesn't start, and the
+failure is treated like a failure of the main command, for the purposes of
+`Opt.RestartMode` and `Backoff`. In build mode, the failure is only reported,
+and the previous subprocess keeps running.
+*/
+func (self *Cmd) RunSteps(gen int64, args []string, steps []Step) {
+	ctx, cancel := context.WithCancel(context.Background())
+	before := &Before{Cancel: cancel}
+	before.Done.Init()
+
+	self.Lock.Lock()
+	self.Before = before
+	self.Lock.Unlock()
+
+	go func() {
+		defer close(before.Done)
+		if self.runSteps(ctx, gen, steps) {
+			self.Start(gen, args)
+		}
+	}()
+}
+
+/*
+Cancels the in-flight pipeline, if any, and waits for it to stop. Once this
+returns, the pipeline can no longer start the main command.
+*/
+func (self *Cmd) CancelBefore() {
+	self.Lock.Lock()
+	before := self.Before
+	self.Before = nil
+	self.Lock.Unlock()
+
+	if before != nil {
+		before.Cancel()
+		<-before.Done
+	}
+}
+
+// Returns true if all steps succeeded and the pipeline wasn't cancelled.
+func (self *Cmd) runSteps(ctx context.Context, gen int64, steps []Step) bool {
+	task := self.Task()
+	opt := task.Opt
+	log := opt.Logger()
+
+	for ind, step := range steps {
+		if task.IsVerb() {
+			log.Printf(`running step %v of %v: %q`, ind+1, len(steps), step.Desc)
+		}
+
+		start := time.Now()
+		tail := task.Proxy.NewTail()
+		err := self.runStep(ctx, step, tail)
+		if ctx.Err() != nil {
+			if task.IsVerb() {
+				log.Printf(`cancelled step %v of %v: %q`, ind+1, len(steps), step.Desc)
+			}
+			return false
+		}
+		if err == nil {
+			continue
+		}
+
+		log.Printf(
+			`step %v of %v %q failed after %v, skipping the command: %v`,
+			ind+1, len(steps), step.Desc, time.Since(start), err,
+		)
+		opt.TermSuf()
+
+		// The proxy keeps forwarding to the previous subprocess. See `Proxy`.
+		if opt.Build && self.IsRunning() {
+			log.Println(`keeping the previous subprocess running`)
+			return false
+		}
+
+		task.Proxy.OnFail(fmt.Sprintf(`step %q failed: %v`, step.Desc, err), tail.String())
+		if opt.Build {
+			return false
+		}
+
+		if self.Gen.Load() == gen {
+			self.Backoff.OnExit(err, time.Now())
+			self.OnExit(err, 0, gen)
+		}
+		return false
+	}
+	return true
+}
+
+// The tail of stderr is captured for `Proxy`, if active.
+func (self *Cmd) runStep(ctx context.Context, step Step, tail *TailBuf) error {
+	task := self.Task()
+	opt := task.Opt
+
+	cmd := exec.CommandContext(ctx, step.Args[0], step.Args[1:]...)
+	cmd.Stdout = task.Stdout
+	cmd.Stderr = task.Stderr
+	if tail != nil {
+		cmd.Stderr = io.MultiWriter(task.Stderr, tail)
+	}
+
+	// Like `Cmd.Stop`, this signals the entire process tree of the step, since
+	// tools such as "go generate" spawn their own subprocesses.
+	cmd.Cancel = func() error {
+		self.BroadcastTree(cmd.Process.Pid, opt.StopSig.Signal())
+		return nil
+	}
+	cmd.WaitDelay = opt.StopWait.Duration()
+	if cmd.WaitDelay <= 0 {
+		cmd.WaitDelay = STOP_WAIT_KILL
+	}
+
+	defer flushWriter(task.Stderr)
+	defer flushWriter(task.Stdout)
+	return cmd.Run()
+}
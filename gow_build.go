@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Build mode, enabled via `Opt.Build`, replaces "go run" with "go build" followed
+by running the built executable. The previous subprocess keeps running until
+the new build succeeds. On build failure, the compiler errors are printed, and
+the previous subprocess is left alone.
+
+Builds alternate between two slots in a temporary directory, so that a build
+never overwrites the executable of the running subprocess.
+*/
+func (self *Cmd) BuildInit() {
+	dir, err := os.MkdirTemp(``, `gow_build_`)
+	if err != nil {
+		panic(gg.Wrap(err, `unable to create a temporary directory for build mode`))
+	}
+	self.BuildDir = dir
+}
+
+func (self *Cmd) BuildDeinit() {
+	if self.BuildDir != `` {
+		gg.Nop1(os.RemoveAll(self.BuildDir))
+		self.BuildDir = ``
+	}
+}
+
+// Path of the executable in the given slot. See `Cmd.BuildInit`.
+func (self *Cmd) BuildPath(args GoArgs, slot int) string {
+	return filepath.Join(self.BuildDir, strconv.Itoa(slot), buildName(args))
+}
+
+func (self *Cmd) BuildStep(src []string) Step {
+	args := ParseGoArgs(src)
+	path := self.BuildPath(args, 1-self.BuildSlot)
+	out := gg.Concat(
+		[]string{self.Task().Opt.Cmd, `build`, `-o`, path},
+		args.Flags,
+		args.Pkgs,
+	)
+	return Step{Desc: strings.Join(out, ` `), Args: out}
+}
+
+/*
+Called after a successful build. Stops the previous subprocess, if any, then
+runs the new executable with the program arguments from `Opt.Args`.
+*/
+func (self *Cmd) StartBuilt(src []string) {
+	opt := self.Task().Opt
+	if self.IsRunning() {
+		if self.Task().IsVerb() {
+			opt.Logger().Println(`build succeeded, replacing the previous subprocess`)
+		}
+		self.StopProc(opt.StopSig.Signal())
+	}
+
+	args := ParseGoArgs(src)
+	self.BuildSlot = 1 - self.BuildSlot
+	self.Exec(self.Gen.Add(1), self.BuildPath(args, self.BuildSlot), args.Rest)
+}
+
+/*
+Name of the built executable, which becomes the process name of the
+subprocess. Uses the name of the package directory, like "go build".
+*/
+func buildName(args GoArgs) string {
+	pkg := gg.Head(args.PkgsOrDefault())
+	if strings.HasSuffix(pkg, `.go`) {
+		return strings.TrimSuffix(filepath.Base(pkg), `.go`)
+	}
+	return filepath.Base(toAbsPath(pkg))
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -10,55 +13,365 @@ import (
 	"github.com/mitranim/gg"
 )
 
+/*
+`.Gen` is incremented whenever we start or stop a subprocess, including when
+the user stops it via hotkeys. Each subprocess remembers the generation at which it
+was started, which allows to tell whether it exited on its own, or was stopped
+on purpose.
+
+`.Restarts` counts consecutive restarts caused by `Opt.RestartMode`. Reset by
+manual and FS restarts, and by healthy runs; see `Cmd.OnExit`.
+
+`.Pid` is the pid of the current subprocess, or 0 when there's none. Signals are
+sent only to this process and its descendants, which allows multiple tasks to
+control their subprocesses independently; see `Task`.
+
+`.Before` is the in-flight pipeline of steps, if any; see `Cmd.Steps`.
+
+`.BuildDir` and `.BuildSlot` are used in build mode; see `Opt.Build`.
+
+`.ReadyPid` is the pid of the last subprocess which passed readiness probes;
+see `Cmd.AwaitReady`.
+
+`.Input` is the input of the current subprocess in raw mode; see `Input`.
+*/
 type Cmd struct {
-	Mained
-	Count atomic.Int64
+	Tasked
+	Count     atomic.Int64
+	Pid       atomic.Int64
+	Gen       atomic.Int64
+	Restarts  atomic.Int64
+	Backoff   Backoff
+	Lock      sync.Mutex
+	Before    *Before
+	BuildDir  string
+	BuildSlot int
+	ReadyPid  atomic.Int64
+	Input     Input
 }
 
 func (self *Cmd) Deinit() {
+	self.CancelBefore()
 	if self.Count.Load() > 0 {
-		self.Broadcast(syscall.SIGTERM)
+		self.Stop(self.Task().Opt.StopSig.Signal())
 	}
 }
 
+/*
+Sends the given signal to the subprocess and its descendants, then waits for
+them to exit, up to `Opt.StopWait`. Any subprocesses still running after that
+are killed with SIGKILL. Waiting ensures that resources held by the old
+subprocess, such as listening ports, are released before we start a new one.
+Also cancels the in-flight `Opt.Before` pipeline, if any.
+*/
+func (self *Cmd) Stop(sig syscall.Signal) {
+	self.CancelBefore()
+	self.StopProc(sig)
+}
+
+// Like `Cmd.Stop`, but doesn't affect the in-flight pipeline.
+func (self *Cmd) StopProc(sig syscall.Signal) {
+	self.Task().Proxy.Pause()
+	self.Gen.Add(1)
+	pids := self.Broadcast(sig)
+	opt := self.Task().Opt
+	wait := opt.StopWait.Duration()
+	if gg.IsEmpty(pids) || wait <= 0 {
+		return
+	}
+
+	if awaitPids(pids, wait) {
+		return
+	}
+
+	pids = gg.Filter(pids, isPidAlive)
+	opt.Logger().Printf(
+		`subprocesses did not exit within %v after signal %q, sending %q to pids: %v`,
+		wait, sig, syscall.SIGKILL, pids,
+	)
+	for _, pid := range pids {
+		gg.Nop1(syscall.Kill(pid, syscall.SIGKILL))
+	}
+	awaitPids(pids, STOP_WAIT_KILL)
+}
+
 /*
 Note: proc count may change immediately after the call. Decision making at the
 callsite must account for this.
 */
-func (self *Cmd) IsRunning() bool { return self.Count.Load() == 0 }
+func (self *Cmd) IsRunning() bool { return self.Count.Load() > 0 }
 
 func (self *Cmd) Restart() {
-	self.Deinit()
+	task := self.Task()
+	opt := task.Opt
+
+	/**
+	In build mode, the previous subprocess keeps running until the new build
+	succeeds; see `Cmd.StartBuilt`.
+	*/
+	var gen int64
+	if opt.Build {
+		self.CancelBefore()
+		gen = self.Gen.Load()
+	} else {
+		self.Deinit()
+		gen = self.Gen.Add(1)
+	}
+
+	paths, manual := task.Pending.Take()
+	if manual || gg.IsNotEmpty(paths) {
+		self.Restarts.Store(0)
+	}
+	args := self.Args(paths, manual)
+	task.Emit(Event{Type: EventTypeRestart, Reason: restartReason(paths, manual), Paths: paths})
+
+	steps := self.Steps(args)
+	if gg.IsNotEmpty(steps) {
+		self.RunSteps(gen, args, steps)
+		return
+	}
+	self.Start(gen, args)
+}
+
+func (self *Cmd) Start(gen int64, args []string) {
+	if self.Task().Opt.Build {
+		self.StartBuilt(args)
+		return
+	}
+	self.Exec(gen, self.Task().Opt.Cmd, args)
+}
 
-	main := self.Main()
-	opt := main.Opt
-	cmd := exec.Command(opt.Cmd, opt.Args...)
+func (self *Cmd) Exec(gen int64, name string, args []string) {
+	task := self.Task()
+	main := task.Main()
+	opt := task.Opt
+	cmd := exec.Command(name, args...)
 
-	if !main.Term.IsActive() {
+	// Concurrent tasks can't share stdin.
+	if !main.Term.IsActive() && !main.IsMultiTask() {
 		cmd.Stdin = os.Stdin
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = task.Stdout
+	cmd.Stderr = task.Stderr
 
+	// Log probes need a copy of the output. See `FlagReady`.
+	logs := NewReadyLog(opt.Ready)
+	if logs != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, logs)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, logs)
+	}
+
+	// The proxy shows the tail of stderr if the subprocess fails.
+	tail := task.Proxy.NewTail()
+	if tail != nil {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, tail)
+	}
+
+	input := self.OpenInput(cmd, logs, tail)
+
+	task.Proxy.Pause()
 	err := cmd.Start()
 	if err != nil {
-		log.Println(`unable to start subcommand:`, err)
+		opt.Logger().Println(`unable to start subcommand:`, err)
+		input.Abort()
 		return
 	}
 
 	self.Count.Add(1)
-	go self.ReportCmd(cmd, time.Now())
+	self.Pid.Store(int64(cmd.Process.Pid))
+	input.Start()
+	self.SetInput(input)
+	task.Emit(Event{Type: EventTypeStart, Pid: cmd.Process.Pid, Args: cmd.Args})
+	go self.ReportCmd(cmd, time.Now(), gen, tail, input)
+	go self.AwaitReady(cmd.Process.Pid, logs)
+}
+
+/*
+In raw mode, our stdin is reserved for hotkeys, and other input is forwarded to
+the subprocess according to `StdinMode`; see `Stdio.OnInput`. The subprocess
+gets either a pseudo-terminal, or a stdin pipe. Multiple tasks can't share our
+terminal, and get pipes. If the returned input is inactive, the command keeps
+the stdio configured by `Cmd.Exec`.
+*/
+func (self *Cmd) OpenInput(cmd *exec.Cmd, logs *ReadyLog, tail *TailBuf) (out Input) {
+	main := self.Task().Main()
+	mode := main.Opt.Stdin
+	if !main.Term.IsActive() || mode == StdinModeNone {
+		return
+	}
+
+	if mode == StdinModePty && !main.IsMultiTask() {
+		out.Pty = self.OpenPty(cmd, logs, tail)
+		if out.Pty != nil {
+			return
+		}
+	}
+
+	pipe, err := OpenPipe()
+	if err != nil {
+		self.Task().Opt.Logger().Println(err)
+		return
+	}
+	pipe.Attach(cmd)
+	out.Pipe = pipe
+	return
+}
+
+// Returns nil if a PTY is unavailable. See `Pty`.
+func (self *Cmd) OpenPty(cmd *exec.Cmd, logs *ReadyLog, tail *TailBuf) *Pty {
+	task := self.Task()
+
+	out := []io.Writer{task.Stdout}
+	if logs != nil {
+		out = append(out, logs)
+	}
+	if tail != nil {
+		out = append(out, tail)
+	}
+
+	pty, err := OpenPty(io.MultiWriter(out...))
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			task.Opt.Logger().Println(err)
+		}
+		return nil
+	}
+	pty.Attach(cmd)
+	return pty
+}
+
+/*
+Called when the subprocess exits. Locking prevents a concurrent readiness report
+from overriding the exit; see `Cmd.AwaitReady`.
+*/
+func (self *Cmd) ClearPid(pid int) {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Pid.CompareAndSwap(int64(pid), 0)
+}
+
+func (self *Cmd) GetInput() Input {
+	defer gg.Lock(&self.Lock).Unlock()
+	return self.Input
+}
+
+func (self *Cmd) SetInput(val Input) {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Input = val
 }
 
-func (self *Cmd) ReportCmd(cmd *exec.Cmd, start time.Time) {
+// Clears the input only if it wasn't replaced by the next subprocess.
+func (self *Cmd) ClearInput(val Input) {
+	defer gg.Lock(&self.Lock).Unlock()
+	if self.Input == val {
+		self.Input = Input{}
+	}
+}
+
+/*
+Returns the arguments for the next subprocess. Usually these are just
+`Opt.Args`, but with `Opt.TestAffected`, automatic restarts may test only some
+of the packages.
+*/
+func (self *Cmd) Args(paths []string, manual bool) []string {
+	opt := self.Task().Opt
+	if !opt.TestAffected || manual {
+		return opt.Args
+	}
+
+	args, ok := AffectedTestArgs(opt, paths)
+	if !ok {
+		return opt.Args
+	}
+	if self.Task().IsVerb() {
+		opt.Logger().Printf(`testing affected packages: %q`, args)
+	}
+	return args
+}
+
+func (self *Cmd) ReportCmd(cmd *exec.Cmd, start time.Time, gen int64, tail *TailBuf, input Input) {
 	defer self.Count.Add(-1)
-	opt := self.Main().Opt
-	opt.LogCmdExit(cmd.Wait(), time.Since(start))
-	opt.TermSuf()
+	task := self.Task()
+	opt := task.Opt
+	err := cmd.Wait()
+	dur := time.Since(start)
+	self.ClearPid(cmd.Process.Pid)
+	input.Deinit()
+	self.ClearInput(input)
+	flushWriter(task.Stdout)
+	flushWriter(task.Stderr)
+	task.LogCmdExit(err, dur)
+	task.Emit(exitEvent(cmd.Process.Pid, err, dur))
+
+	// Already printed if the subprocess became ready. See `Cmd.AwaitReady`.
+	if !self.ReadyPid.CompareAndSwap(int64(cmd.Process.Pid), 0) {
+		opt.TermSuf()
+	}
+
+	if self.Gen.Load() == gen {
+		task.Proxy.OnFail(exitDesc(err), tail.String())
+		self.Backoff.OnExit(err, time.Now())
+		self.OnExit(err, dur, gen)
+	}
+}
+
+func exitDesc(err error) string {
+	if err == nil {
+		return `subprocess exited`
+	}
+	return `subprocess exited: ` + err.Error()
+}
+
+/*
+Called when the subprocess exits on its own. Schedules a restart according to
+`Opt.RestartMode`. The restart goes through `Task.Run`, and is subject to
+crash-loop backoff.
+
+A run which lasted at least `Opt.RestartWindow` is considered healthy, and
+resets the count of consecutive restarts, which means that `Opt.RestartMax`
+limits only restarts in quick succession. This is independent from crash-loop
+backoff; see `Backoff`.
+*/
+func (self *Cmd) OnExit(err error, dur time.Duration, gen int64) {
+	task := self.Task()
+	opt := task.Opt
+	if dur >= opt.RestartWindow.Duration() {
+		self.Restarts.Store(0)
+	}
+	if !opt.RestartMode.ShouldRestart(err) {
+		return
+	}
+
+	count := self.Restarts.Add(1)
+	if opt.RestartMax > 0 && count > int64(opt.RestartMax) {
+		opt.Logger().Printf(`subprocess exited, not restarting: reached the limit of %v consecutive restarts`, opt.RestartMax)
+		return
+	}
+
+	if self.Task().IsVerb() {
+		opt.Logger().Printf(`subprocess exited, restarting in %v (restart mode %q)`, opt.RestartDelay, opt.RestartMode)
+	}
+
+	time.AfterFunc(opt.RestartDelay.Duration(), func() {
+		// Skip if the subprocess was restarted or stopped in the meantime.
+		if self.Gen.Load() == gen {
+			task.RestartAuto()
+		}
+	})
+}
+
+/*
+Broadcasts a signal on the user's behalf, for example via hotkeys. A
+subprocess stopped this way is considered to be stopped on purpose: it's not
+restarted by `Opt.RestartMode`, and its exit doesn't count as a failure.
+*/
+func (self *Cmd) Interrupt(sig syscall.Signal) {
+	self.CancelBefore()
+	self.Gen.Add(1)
+	self.Broadcast(sig)
 }
 
 /*
-Sends the signal to all subprocesses (descendants included).
+Sends the signal to the current subprocess and its descendants.
 
 Worth mentioning: across all the various Go versions tested (1.11 to 1.24), it
 seemed that the `go` commands such as `go run` or `go test` do not forward any
@@ -74,25 +387,56 @@ a signal, we would send it to `-proc.Pid`. Which did seem to work for killing
 descendant processes. But creating a subprocess group interferes with stdio and
 TTY detection in descendant processes, so we had to give it up, replacing with
 the solution below.
+
+Returns the pids to which the signal was sent.
 */
-func (self *Cmd) Broadcast(sig syscall.Signal) {
-	verb := self.Main().Opt.Verb
-	pids, err := SubPids(os.Getpid(), verb)
+func (self *Cmd) Broadcast(sig syscall.Signal) []int {
+	pid := int(self.Pid.Load())
+	if pid == 0 {
+		return nil
+	}
+	return self.BroadcastTree(pid, sig)
+}
+
+// Sends the signal to the given process and its descendants.
+func (self *Cmd) BroadcastTree(pid int, sig syscall.Signal) []int {
+	verb := self.Task().IsVerb()
+	log := self.Task().Opt.Logger()
+
+	pids, err := SubPids(pid, verb)
 	if err != nil {
 		log.Println(err)
-		return
-	}
-	if gg.IsEmpty(pids) {
-		return
+		return nil
 	}
 
-	if !verb {
+	/**
+	The process itself goes first. Otherwise, a shell running a sequence of
+	commands could react to the exit of its current command by starting the
+	next one. Descendants are collected beforehand, and are signaled even if the
+	process has already exited.
+	*/
+	pids = gg.Concat([]int{pid}, pids)
+	sent := self.broadcastPids(pids, sig)
+	self.Task().Emit(Event{
+		Type:   EventTypeSignalBroadcast,
+		Signal: FlagSignal(sig).String(),
+		Pids:   sent,
+	})
+	return sent
+}
+
+func (self *Cmd) broadcastPids(pids []int, sig syscall.Signal) []int {
+	if !self.Task().IsVerb() {
+		var sent []int
 		for _, pid := range pids {
-			gg.Nop1(syscall.Kill(pid, sig))
-			return
+			if syscall.Kill(pid, sig) == nil {
+				sent = append(sent, pid)
+			}
 		}
+		return sent
 	}
 
+	log := self.Task().Opt.Logger()
 	var sent []int
 	var unsent []int
 	var errs []error
@@ -118,4 +462,38 @@ func (self *Cmd) Broadcast(sig syscall.Signal) {
 			sig, len(pids), sent, unsent, errs,
 		)
 	}
+	return sent
+}
+
+// Used by `Cmd.Stop` to wait for subprocesses killed with SIGKILL.
+const STOP_WAIT_KILL = time.Second
+
+// Interval of checking whether subprocesses are still running.
+const STOP_POLL_DELAY = time.Millisecond * 10
+
+/*
+Waits until none of the given processes are running, or until the timeout.
+Returns true if all processes have exited.
+*/
+func awaitPids(pids []int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !gg.Some(pids, isPidAlive) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(STOP_POLL_DELAY)
+	}
+}
+
+/*
+Signal 0 performs error checking without sending anything. `EPERM` means that
+the process exists, but belongs to someone else, which may happen when a
+descendant changes its user.
+*/
+func isPidAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	r "reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+const CONFIG_FILE = `gow.json`
+
+// Not supported. See `FindConfig`.
+const CONFIG_FILE_TOML = `gow.toml`
+
+// Prefix of CLI args which select named profiles from the config file.
+const PROFILE_PREFIX = `@`
+
+/*
+Project configuration, loaded from "gow.json" in CWD or the closest parent
+directory which has one. JSON is the only supported format; TOML and YAML are
+not. Keys correspond to the `json` tags of `Opt` fields,
+and values are converted to CLI flags, which are then parsed like any other
+flags. This keeps a single source of truth for parsing and validation.
+Example:
+
+	{
+		"clear": true,
+		"verbose": true,
+		"extensions": ["go", "mod", "html"],
+		"ignore": ["target"],
+		"args": ["run", "."],
+		"profiles": {
+			"server": {"args": ["run", "./cmd/server"], "restart": "on-failure"},
+			"test": {"args": ["test", "./..."], "test_affected": true}
+		}
+	}
+
+Profiles are selected via "@name" arguments, such as `gow @server`. Keys of a
+profile replace the same keys at the top level. CLI flags replace values from
+the file, including multi flags such as "-e".
+
+Path rules from "extensions", "include" and "exclude" apply in that order.
+Extensions and includes from env vars and CLI flags don't cancel the excludes
+of the config file; passing "--exclude" replaces them. See `Opt.LayerArgs`.
+
+Relative paths in "watch" and "ignore", and relative globs in "include" and
+"exclude", are resolved relative to the directory of the config file. The
+resulting globs are absolute; see `PathRule.Match`. Extensions match at any
+depth, and need no resolving.
+*/
+type Config struct {
+	Path     string
+	Base     ConfigOpt
+	Profiles map[string]ConfigOpt
+}
+
+// Config keys mapped to JSON values. See `Config`.
+type ConfigOpt map[string]json.RawMessage
+
+func (self *Config) Read(path string) {
+	src := gg.Try1(os.ReadFile(path))
+
+	var base ConfigOpt
+	err := json.Unmarshal(src, &base)
+	if err != nil {
+		panic(gg.Wrapf(err, `unable to decode config file %q`, path))
+	}
+
+	self.Path = path
+	if gg.MapHas(base, `profiles`) {
+		err := json.Unmarshal(base[`profiles`], &self.Profiles)
+		if err != nil {
+			panic(gg.Wrapf(err, `unable to decode profiles in config file %q`, path))
+		}
+		delete(base, `profiles`)
+	}
+	self.Base = base
+}
+
+/*
+Returns the config opts for the given profile: top-level keys, replaced by
+keys of the profile. An empty name selects only the top-level keys.
+*/
+func (self Config) Opt(profile string) ConfigOpt {
+	out := gg.MapClone(self.Base)
+	if out == nil {
+		out = ConfigOpt{}
+	}
+	if profile == `` {
+		return out
+	}
+
+	val, ok := self.Profiles[profile]
+	if !ok {
+		panic(gg.Errf(
+			`unknown profile %q in config file %q; known profiles: %q`,
+			profile, self.Path, gg.SortedPrim(gg.MapKeys(self.Profiles)),
+		))
+	}
+	for key, val := range val {
+		out[key] = val
+	}
+	return out
+}
+
+/*
+Converts config opts into equivalent CLI flags, and separately returns the
+positional args from the "args" key. Flags are emitted in the order of `Opt`
+fields, like in `EnvFlags`. Since JSON objects are unordered, this is the only
+order we can use for path rules: extensions, then includes, then excludes.
+*/
+func (self Config) Flags(src ConfigOpt) (flags []string, args []string) {
+	if gg.MapHas(src, `args`) {
+		err := json.Unmarshal(src[`args`], &args)
+		if err != nil {
+			panic(gg.Wrapf(err, `invalid "args" in config file %q`, self.Path))
+		}
+	}
+
+	for _, key := range gg.SortedPrim(gg.MapKeys(src)) {
+		if key != `args` && !optHasKey(key) {
+			panic(gg.Errf(`unknown key %q in config file %q`, key, self.Path))
+		}
+	}
+
+	for _, field := range gg.FlagDefCache.Get(gg.Type[Opt]()).Flags {
+		key := optFieldKey(field)
+		val, ok := src[key]
+		if key == `` || field.Flag == `` || !ok {
+			continue
+		}
+
+		vals, err := configVals(val)
+		if err != nil {
+			panic(gg.Wrapf(err, `invalid value of %q in config file %q`, key, self.Path))
+		}
+
+		for _, val := range vals {
+			if isConfigPathField(field) {
+				val = self.Resolve(val)
+			} else if isConfigGlobField(field) {
+				val = self.ResolveGlob(val)
+			}
+			flags = append(flags, field.Flag+`=`+val)
+		}
+	}
+	return
+}
+
+// Resolves a relative path against the directory of the config file.
+func (self Config) Resolve(path string) string {
+	if path == `` || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(self.Path), path)
+}
+
+/*
+Resolves a relative glob against the directory of the config file. The result
+is slash-separated, like other globs; see `makePathRule`.
+*/
+func (self Config) ResolveGlob(src string) string {
+	return filepath.ToSlash(self.Resolve(filepath.FromSlash(src)))
+}
+
+/*
+Searches for the config file in the given directory and its parents. Returns
+nil if there is none. A "gow.toml" file found first is an error rather than
+being silently ignored, since TOML is not supported.
+*/
+func FindConfig(dir string) *Config {
+	for {
+		path := filepath.Join(dir, CONFIG_FILE)
+		_, err := os.Stat(path)
+		if err == nil {
+			var out Config
+			out.Read(path)
+			return &out
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			panic(gg.Wrapf(err, `unable to access config file %q`, path))
+		}
+
+		toml := filepath.Join(dir, CONFIG_FILE_TOML)
+		if gg.FileExists(toml) {
+			panic(gg.Errf(`unsupported config file %q: TOML is not supported, use %q instead`, toml, CONFIG_FILE))
+		}
+
+		next := filepath.Dir(dir)
+		if next == dir {
+			return nil
+		}
+		dir = next
+	}
+}
+
+func optHasKey(key string) bool {
+	return gg.Some(gg.FlagDefCache.Get(gg.Type[Opt]()).Flags, func(field gg.FlagDefField) bool {
+		return field.Flag != `` && optFieldKey(field) == key
+	})
+}
+
+// Config key of an `Opt` field. Fields with `json:"-"` have no key.
+func optFieldKey(field gg.FlagDefField) string {
+	key, _, _ := strings.Cut(field.Tag.Get(`json`), `,`)
+	if key == `-` {
+		return ``
+	}
+	return key
+}
+
+func isConfigPathField(field gg.FlagDefField) bool {
+	return field.Type == gg.Type[FlagWatchDirs]() || field.Type == gg.Type[FlagIgnoreDirs]()
+}
+
+func isConfigGlobField(field gg.FlagDefField) bool {
+	return field.Type == gg.Type[FlagInclude]() || field.Type == gg.Type[FlagExclude]()
+}
+
+/*
+Converts a JSON value into flag values. Arrays become multiple values, which
+is how multi flags are passed. Null becomes an empty value, which suppresses
+the default, like passing "-flag=" in the CLI.
+*/
+func configVals(src json.RawMessage) ([]string, error) {
+	var val any
+	err := json.Unmarshal(src, &val)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := val.([]any)
+	if !ok {
+		list = []any{val}
+	}
+
+	out := make([]string, 0, len(list))
+	for _, val := range list {
+		str, err := configVal(val)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, str)
+	}
+	return out, nil
+}
+
+func configVal(src any) (string, error) {
+	switch src := src.(type) {
+	case nil:
+		return ``, nil
+	case bool:
+		return strconv.FormatBool(src), nil
+	case float64:
+		return strconv.FormatFloat(src, 'f', -1, 64), nil
+	case string:
+		return src, nil
+	default:
+		return ``, gg.Errf(`unsupported value of type %v`, r.TypeOf(src))
+	}
+}
+
+// Separates leading "@profile" args from the rest.
+func splitProfiles(src []string) (profiles []string, args []string) {
+	for len(src) > 0 && strings.HasPrefix(src[0], PROFILE_PREFIX) {
+		profiles = append(profiles, strings.TrimPrefix(src[0], PROFILE_PREFIX))
+		src = src[1:]
+	}
+	return profiles, src
+}
+
+// Drops flags which were already provided, for example via CLI.
+func dropFlags(src []string, got gg.Set[string]) []string {
+	return gg.Reject(src, func(val string) bool {
+		key, _, _ := strings.Cut(val, `=`)
+		return got.Has(key)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Merges bursts of FS events into a single restart. Operations such as
+`git checkout`, `gofmt -w`, or an editor saving a file via rename, tend to
+produce several events in quick succession. Without merging, each of them
+could cause a separate restart.
+
+The burst is considered settled when no new events arrive within
+`Opt.Debounce`. To avoid postponing the restart indefinitely when events keep
+coming, we also restart after `Opt.DebounceMax` since the first event of the
+burst.
+
+Used only when `Opt.Debounce` is non-zero. Otherwise we restart on every
+allowed event, as before.
+*/
+type Debounce struct {
+	Tasked
+	Events gg.Chan[FsEvent]
+}
+
+func (self *Debounce) Init(task *Task) {
+	self.Tasked.Init(task)
+	self.Events.Init()
+}
+
+func (self *Debounce) IsActive() bool {
+	return self.Task().Opt.Debounce > 0
+}
+
+/*
+Doesn't require special cleanup before stopping `gow`. Terminating the entire
+`gow` process takes care of the goroutine.
+*/
+func (*Debounce) Deinit() {}
+
+func (self *Debounce) Run() {
+	task := self.Task()
+	for {
+		task.OnFsEvents(self.Collect())
+	}
+}
+
+// Blocks until the next burst of events settles. Returns the changed paths.
+func (self *Debounce) Collect() []string {
+	opt := self.Task().Opt
+	var paths gg.OrdSet[string]
+	paths.Add((<-self.Events).Path())
+
+	settle := time.NewTimer(opt.Debounce.Duration())
+	defer settle.Stop()
+
+	var deadline <-chan time.Time
+	if opt.DebounceMax > 0 {
+		timer := time.NewTimer(opt.DebounceMax.Duration())
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case event := <-self.Events:
+			paths.Add(event.Path())
+			settle.Reset(opt.Debounce.Duration())
+
+		case <-settle.C:
+			return paths.Slice
+
+		case <-deadline:
+			return paths.Slice
+		}
+	}
+}
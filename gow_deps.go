@@ -0,0 +1,233 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Restricts restarts to changes in the packages which the target actually
+depends on. Opt-in via `Opt.Deps`. The set of packages is obtained via
+"go list -deps", using the tool from `Opt.Cmd` and the packages and the build
+flags from `Opt.Args`, and includes local packages only: those of the main
+modules, including workspace members, and of modules replaced with local
+directories.
+
+Only ".go" files are filtered by the set of packages. Other files, such as
+templates, are subject only to the usual filters.
+
+The set is recomputed in the background when a "go.mod" or "go.work" file
+changes, or when a Go file in one of the known packages imports something that
+the package didn't previously import.
+
+Local modules outside of `Opt.WatchDirs`, such as replaced modules and
+workspace members, must be watched too; otherwise their packages would never
+trigger restarts. They're kept in `.Outer`, and the watcher is updated whenever
+they change; see `Main.WatchSync`.
+*/
+type Deps struct {
+	Tasked
+	Lock      sync.RWMutex
+	Dirs      gg.Set[string]
+	ModDirs   gg.Set[string]
+	Outer     []string
+	Imports   map[string]gg.Set[string]
+	Recompute gg.Chan[struct{}]
+}
+
+func (self *Deps) Init(task *Task) {
+	self.Tasked.Init(task)
+	self.Recompute.InitCap(1)
+	if self.IsActive() {
+		self.Compute()
+	}
+}
+
+func (self *Deps) IsActive() bool { return self.Task().Opt.Deps }
+
+/*
+Doesn't require special cleanup before stopping `gow`. Terminating the entire
+`gow` process takes care of the goroutine.
+*/
+func (*Deps) Deinit() {}
+
+func (self *Deps) Run() {
+	for range self.Recompute {
+		self.Compute()
+	}
+}
+
+/*
+On failure, keeps the previous state. If there is no previous state, filtering
+is effectively disabled until the next successful attempt.
+*/
+func (self *Deps) Compute() {
+	opt := self.Task().Opt
+	args := ParseGoArgs(opt.Args)
+
+	list := []string{`-deps`}
+	if args.Sub == `test` {
+		list = append(list, `-test`)
+	}
+	list = gg.Concat(list, args.ListFlags(), args.PkgsOrDefault())
+
+	pkgs, err := GoList(opt.Cmd, list...)
+	if err != nil {
+		opt.Logger().Println(`unable to compute package dependencies:`, err)
+		return
+	}
+
+	dirs := gg.Set[string]{}
+	modDirs := gg.Set[string]{}
+	imports := map[string]gg.Set[string]{}
+
+	for _, pkg := range pkgs {
+		if !pkg.IsLocal() || pkg.Dir == `` {
+			continue
+		}
+		dirs.Add(pkg.Dir)
+		modDirs.Add(pkg.Module.SrcDir())
+		set := imports[pkg.Dir]
+		if set == nil {
+			set = gg.Set[string]{}
+			imports[pkg.Dir] = set
+		}
+		set.Add(pkg.AllImports()...)
+	}
+
+	if self.Task().IsVerb() {
+		opt.Logger().Printf(`watching %v local packages of %v modules`, len(dirs), len(modDirs))
+	}
+
+	self.Lock.Lock()
+	self.Dirs = dirs
+	self.ModDirs = modDirs
+	self.Imports = imports
+	self.Lock.Unlock()
+
+	self.SyncOuter()
+}
+
+/*
+Updates `.Outer`, and if it has changed, the watcher. During `Task.Init`, the
+watcher doesn't exist yet, and is later initialized with `Main.WatchDirs`.
+*/
+func (self *Deps) SyncOuter() {
+	task := self.Task()
+	opt := task.Opt
+	next := self.OuterModDirs(opt.WatchDirs)
+
+	self.Lock.Lock()
+	prev := self.Outer
+	self.Outer = next
+	self.Lock.Unlock()
+
+	if gg.Equal(prev, next) {
+		return
+	}
+
+	if task.IsVerb() {
+		for _, dir := range gg.Exclude(next, prev...) {
+			opt.Logger().Printf(`also watching local module %q`, dir)
+		}
+		for _, dir := range gg.Exclude(prev, next...) {
+			opt.Logger().Printf(`no longer watching local module %q`, dir)
+		}
+	}
+
+	main := task.Main()
+	if main != nil {
+		main.WatchSync()
+	}
+}
+
+// Returns the current `.Outer`, which is replaced rather than mutated.
+func (self *Deps) OuterDirs() []string {
+	self.Lock.RLock()
+	defer self.Lock.RUnlock()
+	return self.Outer
+}
+
+// Assumes that the input is an absolute path.
+func (self *Deps) Allow(path string) bool {
+	if !self.IsActive() || isGoModFile(path) || filepath.Ext(path) != `.go` {
+		return true
+	}
+
+	self.Lock.RLock()
+	defer self.Lock.RUnlock()
+	return self.Dirs == nil || self.Dirs.Has(filepath.Dir(path))
+}
+
+// Schedules recomputation when the given path may affect the dependency graph.
+func (self *Deps) OnPath(path string) {
+	if self.IsActive() && (isGoModFile(path) || self.HasNewImports(path)) {
+		self.Recompute.SendZeroOpt()
+	}
+}
+
+/*
+True if the given Go file belongs to a known package and imports something
+that the package didn't import during the last computation.
+*/
+func (self *Deps) HasNewImports(path string) bool {
+	if filepath.Ext(path) != `.go` {
+		return false
+	}
+
+	self.Lock.RLock()
+	known, ok := self.Imports[filepath.Dir(path)]
+	self.Lock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ImportsOnly)
+	if err != nil {
+		return false
+	}
+
+	for _, spec := range file.Imports {
+		val, err := strconv.Unquote(spec.Path.Value)
+		if err == nil && !known.Has(val) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the directories of local modules which are not located inside any of
+the given watched directories, such as replaced modules and workspace members
+outside of CWD. See `.Outer`.
+*/
+func (self *Deps) OuterModDirs(watched []string) (out []string) {
+	self.Lock.RLock()
+	defer self.Lock.RUnlock()
+
+	for dir := range self.ModDirs {
+		if !gg.Some(watched, func(val string) bool {
+			return isPathInside(dir, toAbsPath(val))
+		}) {
+			out = append(out, dir)
+		}
+	}
+	gg.SortPrim(out)
+	return
+}
+
+func isGoModFile(path string) bool {
+	base := filepath.Base(path)
+	return base == `go.mod` || base == `go.work`
+}
+
+// Both inputs must be clean absolute paths.
+func isPathInside(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, toDirPath(dir))
+}
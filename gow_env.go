@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	r "reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+const ENV_PREFIX = `GOW_`
+
+/*
+Where the effective value of an `Opt` field came from. In order of increasing
+priority: built-in default, config file, environment, CLI.
+*/
+type OptSource string
+
+const (
+	OptSourceDefault OptSource = `default`
+	OptSourceConfig  OptSource = `config`
+	OptSourceEnv     OptSource = `env`
+	OptSourceCli     OptSource = `cli`
+)
+
+// Flag names mapped to sources of their values. See `OptSource`.
+type OptSources map[string]OptSource
+
+// Records the given source for the flags in the given CLI args.
+func (self OptSources) Add(src []string, val OptSource) {
+	for _, flag := range src {
+		key, _, _ := strings.Cut(flag, `=`)
+		self[key] = val
+	}
+}
+
+func (self OptSources) Get(key string) OptSource {
+	val, ok := self[key]
+	if ok {
+		return val
+	}
+	return OptSourceDefault
+}
+
+/*
+Name of the environment variable for an `Opt` field, derived from its config
+key. For example, the flag "-c" with the key "clear" becomes "GOW_CLEAR".
+Fields without a config key have no environment variable.
+*/
+func optFieldEnv(field gg.FlagDefField) string {
+	key := optFieldKey(field)
+	if key == `` || field.Flag == `` {
+		return ``
+	}
+	return ENV_PREFIX + strings.ToUpper(key)
+}
+
+/*
+Sources of options other than CLI args: environment variables, and the config
+file, searched in `.Dir` and its parents. The zero value has neither, which
+keeps tests independent from the environment of the developer. See
+`OptEnvSys`.
+*/
+type OptEnv struct {
+	Lookup func(string) (string, bool)
+	Dir    string
+}
+
+// Used by `gow` itself. Tests should specify their own sources.
+func OptEnvSys() OptEnv { return OptEnv{Lookup: os.LookupEnv, Dir: cwd} }
+
+func (self OptEnv) Flags() []string {
+	if self.Lookup == nil {
+		return nil
+	}
+	return EnvFlags(self.Lookup)
+}
+
+// Returns nil if there's no config file.
+func (self OptEnv) Config() *Config {
+	if self.Dir == `` {
+		return nil
+	}
+	return FindConfig(self.Dir)
+}
+
+/*
+Converts environment variables into equivalent CLI flags. Values of "multi"
+flags are passed as-is, and many of them support comma-separated values, for
+example "GOW_EXTENSIONS=go,mod,sql". Boolean values may also be "1" or "0".
+*/
+func EnvFlags(env func(string) (string, bool)) (out []string) {
+	def := gg.FlagDefCache.Get(gg.Type[Opt]())
+
+	for _, field := range def.Flags {
+		name := optFieldEnv(field)
+		if name == `` {
+			continue
+		}
+
+		val, ok := env(name)
+		if !ok {
+			continue
+		}
+
+		if field.Type.Kind() == r.Bool {
+			val = envBool(name, val)
+		}
+		out = append(out, field.Flag+`=`+val)
+	}
+	return
+}
+
+func envBool(name, src string) string {
+	if src == `` {
+		return src
+	}
+	val, err := strconv.ParseBool(src)
+	if err != nil {
+		panic(gg.Errf(`invalid value %q of environment variable %q: expected a boolean such as "1", "0", "true", "false"`, src, name))
+	}
+	return strconv.FormatBool(val)
+}
+
+/*
+Used for "-v" and "-h". Lists each flag with its environment variable,
+effective value, and the source of that value.
+*/
+func (self Opt) FmtSources() string {
+	def := gg.FlagDefCache.Get(gg.Type[Opt]())
+	val := r.ValueOf(self)
+	rows := [][]string{{`flag`, `env`, `value`, `source`}}
+
+	for _, field := range def.Flags {
+		name := optFieldEnv(field)
+		if name == `` {
+			continue
+		}
+		rows = append(rows, []string{
+			field.Flag,
+			name,
+			fmtOptVal(val.FieldByIndex(field.Index)),
+			string(self.Sources.Get(field.Flag)),
+		})
+	}
+	return fmtTable(rows, "\t")
+}
+
+func fmtOptVal(src r.Value) string {
+	if src.Kind() == r.String {
+		return strconv.Quote(src.String())
+	}
+	return fmt.Sprint(src.Interface())
+}
+
+// Formats rows as left-aligned columns, with the given prefix on each line.
+func fmtTable(rows [][]string, prefix string) string {
+	var widths []int
+	for _, row := range rows {
+		for ind, val := range row {
+			if ind >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[ind] = max(widths[ind], len(val))
+		}
+	}
+
+	var buf strings.Builder
+	for _, row := range rows {
+		buf.WriteString(prefix)
+		for ind, val := range row {
+			if ind < len(row)-1 {
+				fmt.Fprintf(&buf, `%-*s  `, widths[ind], val)
+			} else {
+				buf.WriteString(val)
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
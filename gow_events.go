@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mitranim/gg"
+	"github.com/rjeczalik/notify"
+)
+
+// Maximum amount of events waiting to be written. See `Events`.
+const EVENTS_QUEUE = 1024
+
+// Default timeout of writing one event. See `Events`.
+const EVENTS_TIMEOUT = time.Second * 5
+
+/*
+Optional machine-readable stream of lifecycle events, enabled via `Opt.Events`.
+Each event is written as one line of JSON (NDJSON). Meant for editor plugins,
+dashboards, and other tools which would otherwise have to parse our logs. The
+stream is shared by all tasks; events of named tasks include the task name.
+
+Events are sent from the watcher, tasks, and stdin handling, which must not
+wait for the reader. `Events.Send` only enqueues events, and a single goroutine
+writes them. When the queue is full, because the reader is slow or stalled,
+new events are dropped. Writes to sockets have a timeout.
+
+If writing fails, for example because the reader of a socket went away, we log
+the error once and stop writing events, without affecting anything else.
+
+Only the outputs which we opened are closed. `.Out` keeps the output reachable
+for the lifetime of the process; see `EventsFd`.
+*/
+type Events struct {
+	Lock    sync.Mutex
+	Out     io.WriteCloser
+	Queue   chan []byte
+	Done    chan struct{}
+	Timeout time.Duration
+	Drop    bool
+}
+
+/*
+Supported targets:
+
+	fd:<num>      already-open file descriptor, for example "fd:3"; not closed
+	unix:<path>   unix socket which accepts connections, for example from an editor
+	<path>        file, created if missing, appended to otherwise
+*/
+func (self *Events) Init(src string) {
+	if src == `` {
+		return
+	}
+	out, err := openEvents(src)
+	if err != nil {
+		panic(gg.Wrapf(err, `unable to open event stream %q`, src))
+	}
+	if self.Timeout == 0 {
+		self.Timeout = EVENTS_TIMEOUT
+	}
+	self.Out = out
+	self.Queue = make(chan []byte, EVENTS_QUEUE)
+	self.Done = make(chan struct{})
+	go self.Run(out, self.Queue)
+}
+
+/*
+Stops accepting events, and waits for the remaining queued events to be written,
+but no longer than the write timeout, since blocking file descriptors don't
+support deadlines.
+*/
+func (self *Events) Deinit() {
+	queue := self.Detach()
+	if queue == nil {
+		return
+	}
+	close(queue)
+	select {
+	case <-self.Done:
+	case <-time.After(self.Timeout):
+	}
+}
+
+func (self *Events) IsActive() bool {
+	defer gg.Lock(&self.Lock).Unlock()
+	return self.Queue != nil
+}
+
+// Enqueues the event without waiting for it to be written. See `Events`.
+func (self *Events) Send(val Event) {
+	defer gg.Lock(&self.Lock).Unlock()
+	if self.Queue == nil {
+		return
+	}
+	if val.Time.IsZero() {
+		val.Time = time.Now()
+	}
+
+	select {
+	case self.Queue <- append(gg.JsonBytes(val), '\n'):
+		self.Drop = false
+	default:
+		if !self.Drop {
+			self.Drop = true
+			log.Println(`event stream is not keeping up, dropping events`)
+		}
+	}
+}
+
+// Runs on its own goroutine, started by `Events.Init`.
+func (self *Events) Run(out io.WriteCloser, queue chan []byte) {
+	defer close(self.Done)
+	defer out.Close()
+
+	for val := range queue {
+		err := self.Write(out, val)
+		if err != nil {
+			log.Println(`unable to write to event stream, disabling it:`, err)
+			self.Detach()
+			return
+		}
+	}
+}
+
+/*
+Sockets and non-blocking pipes support write deadlines, which prevents a stalled
+reader from blocking the writer forever. Other files don't, which is fine for
+regular files.
+*/
+func (self *Events) Write(out io.Writer, val []byte) error {
+	dead, _ := out.(interface{ SetWriteDeadline(time.Time) error })
+	if dead != nil {
+		gg.Nop1(dead.SetWriteDeadline(time.Now().Add(self.Timeout)))
+	}
+	_, err := out.Write(val)
+	return err
+}
+
+// Stops accepting events. Returns the queue, if it was still active.
+func (self *Events) Detach() chan []byte {
+	defer gg.Lock(&self.Lock).Unlock()
+	out := self.Queue
+	self.Queue = nil
+	return out
+}
+
+func openEvents(src string) (io.WriteCloser, error) {
+	if strings.HasPrefix(src, `fd:`) {
+		fd, err := strconv.ParseUint(strings.TrimPrefix(src, `fd:`), 10, 0)
+		if err != nil {
+			return nil, gg.Wrap(err, `invalid file descriptor`)
+		}
+		return EventsFd{fdFile(uintptr(fd), src)}, nil
+	}
+	if strings.HasPrefix(src, `unix:`) {
+		return net.Dial(`unix`, strings.TrimPrefix(src, `unix:`))
+	}
+	return os.OpenFile(src, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+/*
+File descriptor inherited from the parent process, which owns it, and may
+still use it after we exit, so we don't close it.
+*/
+type EventsFd struct{ *os.File }
+
+func (EventsFd) Close() error { return nil }
+
+/*
+For the standard streams, returns the existing files. Other instances of
+`os.File` for the same descriptors would close them when garbage-collected.
+*/
+func fdFile(fd uintptr, name string) *os.File {
+	switch fd {
+	case 0:
+		return os.Stdin
+	case 1:
+		return os.Stdout
+	case 2:
+		return os.Stderr
+	}
+	return os.NewFile(fd, name)
+}
+
+type EventType string
+
+const (
+	EventTypeFsEvent         EventType = `fs_event`
+	EventTypeRestart         EventType = `restart`
+	EventTypeStart           EventType = `start`
+	EventTypeExit            EventType = `exit`
+	EventTypeSignalBroadcast EventType = `signal_broadcast`
+	EventTypeHotkey          EventType = `hotkey`
+	EventTypeReady           EventType = `ready`
+)
+
+/*
+Fields used by each event type:
+
+	fs_event          path, op
+	restart           reason ("manual", "fs", "auto"), paths
+	start             pid, args
+	exit              pid, code, signal, duration_ms, error
+	signal_broadcast  signal, pids
+	hotkey            key, action
+	ready             pid, duration_ms
+
+"auto" restarts are the initial run and restarts caused by "--restart". The
+exit code is omitted when the subprocess was killed by a signal.
+*/
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Task     string    `json:"task,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Op       string    `json:"op,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Paths    []string  `json:"paths,omitempty"`
+	Pid      int       `json:"pid,omitempty"`
+	Pids     []int     `json:"pids,omitempty"`
+	Args     []string  `json:"args,omitempty"`
+	Code     *int      `json:"code,omitempty"`
+	Signal   string    `json:"signal,omitempty"`
+	Duration int64     `json:"duration_ms,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Action   string    `json:"action,omitempty"`
+}
+
+func fsEventOp(src FsEvent) string {
+	switch src := src.(type) {
+	case notify.EventInfo:
+		return src.Event().String()
+	case PollEvent:
+		return src.Op
+	default:
+		return ``
+	}
+}
+
+func restartReason(paths []string, manual bool) string {
+	if manual {
+		return `manual`
+	}
+	if gg.IsNotEmpty(paths) {
+		return `fs`
+	}
+	return `auto`
+}
+
+func exitEvent(pid int, err error, dur time.Duration) Event {
+	out := Event{Type: EventTypeExit, Pid: pid, Duration: dur.Milliseconds()}
+	if err != nil {
+		out.Error = err.Error()
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return out
+	}
+
+	code := 0
+	if exitErr != nil {
+		status, _ := exitErr.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			out.Signal = FlagSignal(status.Signal()).String()
+			return out
+		}
+		code = exitErr.ExitCode()
+	}
+	out.Code = &code
+	return out
+}
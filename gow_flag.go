@@ -1,10 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mitranim/gg"
+	"golang.org/x/sys/unix"
 )
 
 type FlagStrMultiline string
@@ -20,18 +26,117 @@ func (self FlagStrMultiline) Dump(out io.Writer) {
 	}
 }
 
-type FlagExtensions []string
+type FlagDuration time.Duration
+
+func (self *FlagDuration) Parse(src string) error {
+	val, err := time.ParseDuration(src)
+	if err != nil {
+		return gg.Wrapf(err, `invalid duration %q`, src)
+	}
+	*self = FlagDuration(val)
+	return nil
+}
+
+func (self FlagDuration) Duration() time.Duration { return time.Duration(self) }
+
+func (self FlagDuration) String() string { return self.Duration().String() }
+
+/*
+Embedded in `FlagExtensions`, `FlagInclude`, and `FlagExclude`. While parsing,
+`.Rules` points to `Opt.PathRules`, which is shared by all three flags, and
+records their rules in the order in which the flags were passed. See
+`Opt.ParseArgs`. Outside of parsing, it's nil.
+*/
+type FlagPathRules struct{ Rules *[]PathRule }
+
+func (self FlagPathRules) Add(src ...PathRule) {
+	if self.Rules != nil {
+		gg.Append(self.Rules, src...)
+	}
+}
+
+type FlagExtensions struct {
+	FlagPathRules
+	Vals []string
+}
 
 func (self *FlagExtensions) Parse(src string) (err error) {
 	defer gg.Rec(&err)
 	vals := commaSplit(src)
 	gg.Each(vals, validateExtension)
-	gg.Append(self, vals...)
+	gg.Append(&self.Vals, vals...)
+	self.Add(extPathRules(vals)...)
 	return
 }
 
-func (self FlagExtensions) Allow(path string) bool {
-	return gg.IsEmpty(self) || gg.Has(self, cleanExtension(path))
+func (self FlagExtensions) String() string { return fmt.Sprint(self.Vals) }
+
+// Each extension is equivalent to the include rule "**/*.<ext>".
+func extPathRules(src []string) []PathRule {
+	return gg.Map(src, func(ext string) PathRule { return PathRule{Glob: `**/*.` + ext} })
+}
+
+type FlagInclude struct {
+	FlagPathRules
+	Vals []PathRule
+}
+
+func (self *FlagInclude) Parse(src string) error {
+	rule := makePathRule(src, false)
+	gg.Append(&self.Vals, rule)
+	self.Add(rule)
+	return nil
+}
+
+func (self FlagInclude) String() string { return fmt.Sprint(self.Vals) }
+
+type FlagExclude struct {
+	FlagPathRules
+	Vals []PathRule
+}
+
+func (self *FlagExclude) Parse(src string) error {
+	rule := makePathRule(src, true)
+	gg.Append(&self.Vals, rule)
+	self.Add(rule)
+	return nil
+}
+
+func (self FlagExclude) String() string { return fmt.Sprint(self.Vals) }
+
+/*
+Single include or exclude glob. Extensions, includes, and excludes are parsed
+into separate flags, but must be evaluated in the order in which they were
+passed; see `FlagPathRules`.
+*/
+type PathRule struct {
+	Glob    string
+	Exclude bool
+}
+
+func (self PathRule) String() string { return self.Glob }
+
+func (self PathRule) IsInclude() bool { return !self.Exclude }
+
+func (self PathRule) IsExclude() bool { return self.Exclude }
+
+/*
+Takes a slash-separated path, both relative to CWD and absolute. Relative globs
+match the relative path, while absolute globs, such as those from the config
+file, match the absolute path; see `Config.ResolveGlob`.
+*/
+func (self PathRule) Match(rel, abs string) bool {
+	if strings.HasPrefix(self.Glob, `/`) {
+		return globMatch(self.Glob, abs)
+	}
+	return globMatch(self.Glob, rel)
+}
+
+func makePathRule(src string, exclude bool) PathRule {
+	return PathRule{
+		Glob:    strings.TrimPrefix(filepath.ToSlash(src), `./`),
+		Exclude: exclude,
+	}
 }
 
 type FlagWatchDirs []string
@@ -108,3 +213,194 @@ func (self *EchoMode) Parse(src string) error {
 func (self EchoMode) errInvalid() error {
 	return gg.Errf(`invalid echo mode %v; valid modes: %v`, self, EchoModes)
 }
+
+/*
+How input which is not a hotkey is forwarded to the subprocess in raw mode. In
+"pty" mode, the subprocess runs in a pseudo-terminal, falling back on "pipe"
+mode when a PTY is unavailable; see `Pty`. In "pipe" mode, each byte is written
+to the stdin pipe of the subprocess as soon as it's typed. In "line" mode, `gow`
+buffers and edits a line, and writes it once complete. In "" mode, which is the
+default, the stdin of the subprocess is empty. See `Stdio.OnInput`.
+*/
+const (
+	StdinModeNone StdinMode = 0
+	StdinModePty  StdinMode = 1
+	StdinModePipe StdinMode = 2
+	StdinModeLine StdinMode = 3
+)
+
+var StdinModes = []StdinMode{
+	StdinModeNone,
+	StdinModePty,
+	StdinModePipe,
+	StdinModeLine,
+}
+
+type StdinMode byte
+
+func (self StdinMode) String() string {
+	switch self {
+	case StdinModeNone:
+		return ``
+	case StdinModePty:
+		return `pty`
+	case StdinModePipe:
+		return `pipe`
+	case StdinModeLine:
+		return `line`
+	default:
+		panic(self.errInvalid())
+	}
+}
+
+func (self *StdinMode) Parse(src string) error {
+	switch src {
+	case ``:
+		*self = StdinModeNone
+	case `pty`:
+		*self = StdinModePty
+	case `pipe`:
+		*self = StdinModePipe
+	case `line`:
+		*self = StdinModeLine
+	default:
+		return gg.Errf(`unsupported stdin mode %q; supported modes: %q`, src, gg.Map(StdinModes, StdinMode.String))
+	}
+	return nil
+}
+
+func (self StdinMode) errInvalid() error {
+	return gg.Errf(`invalid stdin mode %v; valid modes: %v`, self, StdinModes)
+}
+
+const (
+	WatchModeNotify WatchMode = 0
+	WatchModePoll   WatchMode = 1
+)
+
+var WatchModes = []WatchMode{
+	WatchModeNotify,
+	WatchModePoll,
+}
+
+type WatchMode byte
+
+func (self WatchMode) String() string {
+	switch self {
+	case WatchModeNotify:
+		return `notify`
+	case WatchModePoll:
+		return `poll`
+	default:
+		panic(self.errInvalid())
+	}
+}
+
+func (self *WatchMode) Parse(src string) error {
+	switch src {
+	case `notify`:
+		*self = WatchModeNotify
+	case `poll`:
+		*self = WatchModePoll
+	default:
+		return gg.Errf(`unsupported watch mode %q; supported modes: %q`, src, gg.Map(WatchModes, WatchMode.String))
+	}
+	return nil
+}
+
+func (self WatchMode) errInvalid() error {
+	return gg.Errf(`invalid watch mode %v; valid modes: %v`, self, WatchModes)
+}
+
+/*
+OS signal specified by name, with or without the "SIG" prefix, in any case,
+or by number. Examples: "SIGTERM", "term", "15".
+*/
+type FlagSignal syscall.Signal
+
+func (self *FlagSignal) Parse(src string) error {
+	val, err := parseSignal(src)
+	*self = FlagSignal(val)
+	return err
+}
+
+func (self FlagSignal) Signal() syscall.Signal { return syscall.Signal(self) }
+
+func (self FlagSignal) String() string { return unix.SignalName(self.Signal()) }
+
+func parseSignal(src string) (syscall.Signal, error) {
+	num, err := strconv.Atoi(src)
+	if err == nil && num > 0 {
+		return syscall.Signal(num), nil
+	}
+
+	name := strings.ToUpper(src)
+	if !strings.HasPrefix(name, `SIG`) {
+		name = `SIG` + name
+	}
+
+	val := unix.SignalNum(name)
+	if val == 0 {
+		return 0, gg.Errf(`unknown signal %q`, src)
+	}
+	return val, nil
+}
+
+const (
+	RestartModeNever     RestartMode = 0
+	RestartModeOnFailure RestartMode = 1
+	RestartModeAlways    RestartMode = 2
+)
+
+var RestartModes = []RestartMode{
+	RestartModeNever,
+	RestartModeOnFailure,
+	RestartModeAlways,
+}
+
+type RestartMode byte
+
+func (self RestartMode) String() string {
+	switch self {
+	case RestartModeNever:
+		return `never`
+	case RestartModeOnFailure:
+		return `on-failure`
+	case RestartModeAlways:
+		return `always`
+	default:
+		panic(self.errInvalid())
+	}
+}
+
+func (self *RestartMode) Parse(src string) error {
+	switch src {
+	case `never`:
+		*self = RestartModeNever
+	case `on-failure`:
+		*self = RestartModeOnFailure
+	case `always`:
+		*self = RestartModeAlways
+	default:
+		return gg.Errf(`unsupported restart mode %q; supported modes: %q`, src, gg.Map(RestartModes, RestartMode.String))
+	}
+	return nil
+}
+
+// Whether to restart a subprocess which exited on its own with the given error.
+func (self RestartMode) ShouldRestart(err error) bool {
+	switch self {
+	case RestartModeNever:
+		return false
+	case RestartModeOnFailure:
+		return err != nil
+	case RestartModeAlways:
+		return true
+	default:
+		panic(self.errInvalid())
+	}
+}
+
+func (self RestartMode) errInvalid() error {
+	return gg.Errf(`invalid restart mode %v; valid modes: %v`, self, RestartModes)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	p "path"
+	"strings"
+)
+
+/*
+Matches a slash-separated path against a glob pattern. Within a single path
+segment, supports the syntax of `path.Match`: "*", "?", character classes,
+escapes. Additionally, a segment consisting of "**" matches any amount of path
+segments, including none. For example, "*.go" matches "one.go" but not
+"one/two.go", while "one/**" matches "one/two/three". Malformed patterns never
+match.
+*/
+func globMatch(pattern, path string) bool {
+	return globMatchSegs(strings.Split(pattern, `/`), strings.Split(path, `/`))
+}
+
+func globMatchSegs(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		head := pattern[0]
+
+		if head == `**` {
+			rest := pattern[1:]
+			for ind := range len(path) + 1 {
+				if globMatchSegs(rest, path[ind:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(path) <= 0 {
+			return false
+		}
+
+		ok, err := p.Match(head, path[0])
+		if err != nil || !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		path = path[1:]
+	}
+	return len(path) <= 0
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Go flags which take a separate value, such as "-tags x" as opposed to
+"-tags=x". Needed to tell flag values apart from package arguments.
+Names are stored without leading dashes.
+*/
+var GO_VALUE_FLAGS = gg.SetOf(
+	`C`, `asmflags`, `bench`, `benchtime`, `blockprofile`, `blockprofilerate`,
+	`buildmode`, `compiler`, `count`, `covermode`, `coverpkg`, `coverprofile`,
+	`cpu`, `cpuprofile`, `exec`, `fuzz`, `fuzzcachedir`, `fuzzminimizetime`,
+	`fuzztime`, `gccgoflags`, `gcflags`, `installsuffix`, `ldflags`, `list`,
+	`memprofile`, `memprofilerate`, `mod`, `modfile`, `mutexprofile`,
+	`mutexprofilefraction`, `o`, `outputdir`, `overlay`, `p`, `parallel`, `pgo`,
+	`pkgdir`, `run`, `shuffle`, `skip`, `tags`, `timeout`, `toolexec`, `trace`,
+	`vet`, `vettool`,
+)
+
+/*
+Go flags which affect the package graph. Passed to "go list" when resolving
+packages. Names are stored without leading dashes.
+*/
+var GO_LIST_FLAGS = gg.SetOf(
+	`asan`, `mod`, `modfile`, `msan`, `overlay`, `race`, `tags`,
+)
+
+/*
+Arguments of a "go" subcommand, split into parts. Parsing is heuristic: we
+only know about the flags of the standard "go" subcommands, and assume that
+non-flag arguments are packages, except for "go run" where everything after
+the package or the list of ".go" files is passed to the program.
+*/
+type GoArgs struct {
+	Sub   string   // Subcommand such as "run" or "test".
+	Flags []string // Flags as passed, with separate values included.
+	Pkgs  []string // Packages, package patterns, or ".go" files.
+	Rest  []string // Program args for "run", or "-args ..." for "test".
+}
+
+func ParseGoArgs(src []string) (out GoArgs) {
+	out.Sub = gg.Head(src)
+	src = gg.Tail(src)
+
+	for len(src) > 0 {
+		head := src[0]
+		src = src[1:]
+
+		if head == `-args` || head == `--args` {
+			out.Rest = append([]string{head}, src...)
+			return
+		}
+
+		if strings.HasPrefix(head, `-`) {
+			out.Flags = append(out.Flags, head)
+			if !strings.Contains(head, `=`) && GO_VALUE_FLAGS.Has(goFlagName(head)) && len(src) > 0 {
+				out.Flags = append(out.Flags, src[0])
+				src = src[1:]
+			}
+			continue
+		}
+
+		out.Pkgs = append(out.Pkgs, head)
+
+		if out.Sub == `run` {
+			for len(src) > 0 && strings.HasSuffix(head, `.go`) && strings.HasSuffix(src[0], `.go`) {
+				out.Pkgs = append(out.Pkgs, src[0])
+				src = src[1:]
+			}
+			out.Rest = src
+			return
+		}
+	}
+	return
+}
+
+// Reassembles the arguments. May reorder flags and packages.
+func (self GoArgs) Args() []string {
+	return gg.Concat([]string{self.Sub}, self.Flags, self.Pkgs, self.Rest)
+}
+
+// Returns the flags which affect the package graph; see `GO_LIST_FLAGS`.
+func (self GoArgs) ListFlags() (out []string) {
+	src := self.Flags
+	for len(src) > 0 {
+		head := src[0]
+		src = src[1:]
+
+		name := goFlagName(head)
+		takesVal := !strings.Contains(head, `=`) && GO_VALUE_FLAGS.Has(name) && len(src) > 0
+
+		if GO_LIST_FLAGS.Has(name) {
+			out = append(out, head)
+			if takesVal {
+				out = append(out, src[0])
+			}
+		}
+		if takesVal {
+			src = src[1:]
+		}
+	}
+	return
+}
+
+// Returns the packages, defaulting to the current directory.
+func (self GoArgs) PkgsOrDefault() []string {
+	if gg.IsEmpty(self.Pkgs) {
+		return []string{`.`}
+	}
+	return self.Pkgs
+}
+
+func goFlagName(src string) string {
+	src = strings.TrimLeft(src, `-`)
+	ind := strings.IndexByte(src, '=')
+	if ind >= 0 {
+		return src[:ind]
+	}
+	return src
+}
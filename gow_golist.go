@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+// Subset of the package description printed by "go list -json".
+type GoPkg struct {
+	Dir          string
+	ImportPath   string
+	Standard     bool
+	Module       *GoModule
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+/*
+True for packages whose sources are local, as opposed to the Go module cache:
+packages of main modules, including workspace members, and of modules
+replaced with local directories.
+*/
+func (self GoPkg) IsLocal() bool {
+	mod := self.Module
+	return !self.Standard && mod != nil &&
+		(mod.Main || (mod.Replace != nil && mod.Replace.Version == ``))
+}
+
+// Imports of the package, including imports of its tests.
+func (self GoPkg) AllImports() []string {
+	return gg.Concat(self.Imports, self.TestImports, self.XTestImports)
+}
+
+// Subset of the module description printed by "go list -json".
+type GoModule struct {
+	Path    string
+	Version string
+	Dir     string
+	Main    bool
+	Replace *GoModule
+}
+
+// Directory of the module sources, considering replacement.
+func (self GoModule) SrcDir() string {
+	if self.Replace != nil && self.Replace.Dir != `` {
+		return self.Replace.Dir
+	}
+	return self.Dir
+}
+
+const GO_LIST_FIELDS = `Dir,ImportPath,Standard,Module,Imports,TestImports,XTestImports`
+
+/*
+Runs "<tool> list -e -json" with the given args, which typically include flags
+and package patterns. The tool is `Opt.Cmd`, usually "go". Errors in individual
+packages are tolerated because the code is often broken while being edited.
+*/
+func GoList(tool string, args ...string) ([]GoPkg, error) {
+	args = gg.Concat([]string{`list`, `-e`, `-json=` + GO_LIST_FIELDS}, args)
+	cmd := exec.Command(tool, args...)
+
+	var stderr gg.Buf
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, gg.Wrapf(err, `unable to run "%v %v": %v`, tool, strings.Join(args, ` `), strings.TrimSpace(stderr.String()))
+	}
+
+	var pkgs []GoPkg
+	dec := json.NewDecoder(strings.NewReader(gg.ToString(out)))
+	for {
+		var pkg GoPkg
+		err := dec.Decode(&pkg)
+		if errors.Is(err, io.EOF) {
+			return pkgs, nil
+		}
+		if err != nil {
+			return nil, gg.Wrapf(err, `unable to decode output of "%v list"`, tool)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Something which can be done via a hotkey. Hotkeys are bound to actions via
+`Opt.Keys`, on top of `DEFAULT_KEYS`. The name is used in flags, the config
+file, and the event stream; see `Events`.
+*/
+type Action struct {
+	Name string
+	Desc string
+	Fun  func(*Stdio, string)
+}
+
+// Registry of all actions available for hotkeys.
+var ACTIONS = []*Action{
+	{`interrupt`, `Kill subprocess with SIGINT. Repeat within 1s to kill gow.`, (*Stdio).OnCodeInterrupt},
+	{`restart`, `Kill subprocess with SIGTERM, restart.`, (*Stdio).OnCodeRestart},
+	{`stop`, `Kill subprocess with SIGTERM. Repeat within 1s to kill gow.`, (*Stdio).OnCodeStop},
+	{`quit`, `Kill subprocess with SIGQUIT. Repeat within 1s to kill gow.`, (*Stdio).OnCodeQuit},
+	{`print_command`, `Print currently running command.`, (*Stdio).OnCodePrintCommand},
+	{`print_help`, `Print hotkey help.`, (*Stdio).OnCodePrintHelp},
+	{`clear`, `Clear terminal.`, (*Stdio).OnCodeClear},
+	{`toggle_verbose`, `Toggle verbose logging.`, (*Stdio).OnCodeToggleVerbose},
+	{`toggle_pause`, `Pause or resume watching; the subprocess keeps running.`, (*Stdio).OnCodeTogglePause},
+}
+
+func actionByName(name string) *Action {
+	return gg.Find(ACTIONS, func(val *Action) bool { return val.Name == name })
+}
+
+func actionNames() []string {
+	return gg.Map(ACTIONS, func(val *Action) string { return val.Name })
+}
+
+/*
+Bindings used unless overridden via `Opt.Keys`. Exact keys may vary between
+terminal apps. For example, `^_` is typed as `^-` in MacOS Terminal and as
+`^?` in iTerm2, and most terminals send the delete code for the backspace key.
+*/
+var DEFAULT_KEYS = Hotkeys{
+	{string(rune(ASCII_END_OF_TEXT)), actionByName(`interrupt`)},
+	{string(rune(ASCII_DEVICE_CONTROL_2)), actionByName(`restart`)},
+	{string(rune(ASCII_DEVICE_CONTROL_4)), actionByName(`stop`)},
+	{string(rune(ASCII_FILE_SEPARATOR)), actionByName(`quit`)},
+	{string(rune(ASCII_UNIT_SEPARATOR)), actionByName(`print_command`)},
+	{string(rune(ASCII_DATA_LINK_ESCAPE)), actionByName(`toggle_pause`)},
+	{string(rune(ASCII_BACKSPACE)), actionByName(`print_help`)},
+	{string(rune(ASCII_DELETE)), actionByName(`print_help`)},
+}
+
+/*
+Binds a key to an action. The key is the input sequence; see `KeyDecoder`. A
+nil action unbinds the key.
+*/
+type KeyBinding struct {
+	Key    string
+	Action *Action
+}
+
+// Inverse of `parseKeyBinding`, for printing.
+func (self KeyBinding) String() string {
+	if self.Action == nil {
+		return keyName(self.Key) + `:`
+	}
+	return keyName(self.Key) + `:` + self.Action.Name
+}
+
+/*
+Hotkey bindings; multi. Format: "<key>:<action>". See `parseKey` for the
+supported keys, and `ACTIONS` for the actions. An empty action unbinds the key.
+*/
+type FlagKeys []KeyBinding
+
+func (self *FlagKeys) Parse(src string) error {
+	val, err := parseKeyBinding(src)
+	if err != nil {
+		return err
+	}
+	gg.Append(self, val)
+	return nil
+}
+
+func parseKeyBinding(src string) (out KeyBinding, err error) {
+	ind := strings.LastIndex(src, `:`)
+	if ind <= 0 {
+		return out, gg.Errf(`invalid hotkey binding %q; expected "<key>:<action>"`, src)
+	}
+
+	out.Key, err = parseKey(src[:ind])
+	if err != nil {
+		return
+	}
+
+	name := src[ind+1:]
+	if name == `` {
+		return
+	}
+
+	out.Action = actionByName(name)
+	if out.Action == nil {
+		err = gg.Errf(`unknown hotkey action %q in %q; known actions: %q`, name, src, actionNames())
+	}
+	return
+}
+
+// Effective hotkey bindings, in the order of `DEFAULT_KEYS` and `Opt.Keys`.
+type Hotkeys []KeyBinding
+
+func NewHotkeys(src FlagKeys) Hotkeys {
+	out := gg.Clone(DEFAULT_KEYS)
+	for _, val := range src {
+		out.Set(val)
+	}
+	return out
+}
+
+// Replaces the binding of the same key, if any. A nil action removes it.
+func (self *Hotkeys) Set(val KeyBinding) {
+	name := keyName(val.Key)
+	ind := gg.FindIndex(*self, func(prev KeyBinding) bool { return keyName(prev.Key) == name })
+
+	if val.Action == nil {
+		if ind >= 0 {
+			*self = gg.Concat((*self)[:ind], (*self)[ind+1:])
+		}
+		return
+	}
+
+	if ind >= 0 {
+		(*self)[ind] = val
+		return
+	}
+	gg.Append(self, val)
+}
+
+/*
+Keys are compared by name, which allows a binding to match all sequences which
+terminals send for the same key. See `keyName`.
+*/
+func (self Hotkeys) Get(key string) *Action {
+	name := keyName(key)
+	for _, val := range self {
+		if keyName(val.Key) == name {
+			return val.Action
+		}
+	}
+	return nil
+}
+
+func (self Hotkeys) Help() string {
+	var buf strings.Builder
+	buf.WriteString(`Control codes / hotkeys:` + NEWLINE)
+
+	if gg.IsEmpty(self) {
+		buf.WriteString(NEWLINE + "\tnone")
+	}
+	for _, val := range self {
+		buf.WriteString(NEWLINE)
+		gg.Nop2(fmt.Fprintf(&buf, "\t%-5v %-11v %v", keyCode(val.Key), keyName(val.Key), val.Action.Desc))
+	}
+	return buf.String()
+}
+
+// Lists all actions available for `Opt.Keys`.
+func actionsHelp() string {
+	var buf strings.Builder
+	buf.WriteString(`Hotkey actions for "--key":` + NEWLINE)
+	for _, val := range ACTIONS {
+		buf.WriteString(NEWLINE)
+		gg.Nop2(fmt.Fprintf(&buf, "\t%-15v %v", val.Name, val.Desc))
+	}
+	return buf.String()
+}
+
+func keyCode(key string) string {
+	if len(key) != 1 {
+		return ``
+	}
+	return strconv.Itoa(int(key[0]))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mitranim/gg"
+)
+
+const (
+	IGNORE_FILE_GIT = `.gitignore`
+	IGNORE_FILE_GOW = `.gowignore`
+)
+
+/*
+Ignore rules loaded from ".gitignore" and ".gowignore" files. Both files use
+the same syntax; see https://git-scm.com/docs/gitignore. ".gowignore" is
+always respected when present; ".gitignore" is opt-in via `Opt.GitIgnore`.
+
+Like in Git, ignore files may be nested. Rules in deeper files override rules
+in shallower files, and later rules override earlier ones. A file inside an
+ignored directory is always ignored, even if negated.
+
+Rules are loaded lazily and cached per directory. The cache of a directory is
+invalidated on FS events for its ignore files; see `Task.OnFsEvent`.
+*/
+type IgnoreFiles struct {
+	Git   bool
+	Root  string
+	Lock  sync.Mutex
+	Cache map[string][]IgnoreRule
+}
+
+func (self *IgnoreFiles) Init(git bool) {
+	self.Git = git
+	self.Root = ignoreRoot(cwd)
+	self.Cache = map[string][]IgnoreRule{}
+}
+
+// Assumes that the input is an absolute path.
+func (self *IgnoreFiles) Allow(path string, isDir bool) bool {
+	return !self.Ignore(path, isDir)
+}
+
+/*
+Assumes that the input is an absolute path. Checks the path itself and each of
+its parent directories, up to `.Root`. Paths outside of `.Root` are never
+ignored.
+*/
+func (self *IgnoreFiles) Ignore(path string, isDir bool) bool {
+	if self == nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(self.Root, path)
+	if err != nil || rel == `.` || isRelOutside(rel) {
+		return false
+	}
+
+	segs := strings.Split(filepath.ToSlash(rel), `/`)
+	for ind := range segs {
+		if self.ignoreSegs(segs[:ind+1], isDir || ind < len(segs)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Evaluates the rules of every ignore file located in the ancestor directories
+of the given relative path. The last matching rule wins.
+*/
+func (self *IgnoreFiles) ignoreSegs(segs []string, isDir bool) (out bool) {
+	dir := self.Root
+	for ind := range segs {
+		rel := strings.Join(segs[ind:], `/`)
+		for _, rule := range self.Rules(dir) {
+			if rule.Match(rel, isDir) {
+				out = !rule.Neg
+			}
+		}
+		dir = filepath.Join(dir, segs[ind])
+	}
+	return
+}
+
+// Returns the rules of the ignore files in the given directory, if any.
+func (self *IgnoreFiles) Rules(dir string) []IgnoreRule {
+	defer gg.Lock(&self.Lock).Unlock()
+
+	out, ok := self.Cache[dir]
+	if ok {
+		return out
+	}
+
+	if self.Git {
+		out = append(out, readIgnoreFile(filepath.Join(dir, IGNORE_FILE_GIT))...)
+	}
+	out = append(out, readIgnoreFile(filepath.Join(dir, IGNORE_FILE_GOW))...)
+	self.Cache[dir] = out
+	return out
+}
+
+// Invalidates cached rules if the given path is an ignore file.
+func (self *IgnoreFiles) OnPath(path string) {
+	if self == nil || !isIgnoreFile(path) {
+		return
+	}
+	defer gg.Lock(&self.Lock).Unlock()
+	delete(self.Cache, filepath.Dir(path))
+}
+
+// Single rule from an ignore file.
+type IgnoreRule struct {
+	Glob    string
+	Neg     bool
+	DirOnly bool
+}
+
+/*
+Matches a slash-separated path relative to the directory of the ignore file.
+Patterns without a slash, other than a trailing one, match at any depth.
+*/
+func (self IgnoreRule) Match(path string, isDir bool) bool {
+	if self.DirOnly && !isDir {
+		return false
+	}
+	return globMatch(self.Glob, path)
+}
+
+func ParseIgnore(src string) (out []IgnoreRule) {
+	for _, line := range gg.SplitLines(src) {
+		rule, ok := parseIgnoreLine(line)
+		if ok {
+			out = append(out, rule)
+		}
+	}
+	return
+}
+
+func parseIgnoreLine(src string) (out IgnoreRule, _ bool) {
+	src = trimIgnoreSpace(src)
+	if src == `` || strings.HasPrefix(src, `#`) {
+		return
+	}
+
+	if strings.HasPrefix(src, `!`) {
+		out.Neg = true
+		src = src[1:]
+	} else if strings.HasPrefix(src, `\`) {
+		// Allows patterns starting with literal "#" or "!".
+		src = src[1:]
+	}
+
+	if strings.HasSuffix(src, `/`) {
+		out.DirOnly = true
+		src = strings.TrimRight(src, `/`)
+	}
+
+	if strings.Contains(src, `/`) {
+		src = strings.TrimPrefix(src, `/`)
+	} else {
+		src = `**/` + src
+	}
+
+	if src == `` || src == `**/` {
+		return
+	}
+	out.Glob = src
+	return out, true
+}
+
+/*
+Trailing spaces are ignored unless escaped with a backslash. Leading spaces are
+significant, as in Git.
+*/
+func trimIgnoreSpace(src string) string {
+	src = strings.TrimSuffix(src, "\r")
+	for strings.HasSuffix(src, ` `) && !strings.HasSuffix(src, `\ `) {
+		src = src[:len(src)-1]
+	}
+	return src
+}
+
+func readIgnoreFile(path string) []IgnoreRule {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return ParseIgnore(gg.ToString(src))
+}
+
+func isIgnoreFile(path string) bool {
+	base := filepath.Base(path)
+	return base == IGNORE_FILE_GIT || base == IGNORE_FILE_GOW
+}
+
+/*
+Ignore files in parent directories of CWD apply to us too, but only within the
+same repository. Returns the closest ancestor containing ".git", or the input
+if there is none.
+*/
+func ignoreRoot(dir string) string {
+	for cur := dir; ; {
+		_, err := os.Stat(filepath.Join(cur, `.git`))
+		if err == nil {
+			return cur
+		}
+
+		next := filepath.Dir(cur)
+		if next == cur {
+			return dir
+		}
+		cur = next
+	}
+}
+
+func isRelOutside(rel string) bool {
+	return rel == `..` || strings.HasPrefix(rel, `..`+PATH_SEP)
+}
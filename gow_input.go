@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+How long forwarding of input waits for the subprocess to read it. After that,
+the input is dropped. Prevents a subprocess which doesn't read its stdin from
+blocking our hotkeys. See `Stdio.OnInput`.
+*/
+const STDIN_WRITE_WAIT = time.Millisecond * 100
+
+/*
+Input of one subprocess in raw mode: a PTY, a pipe, or neither. See
+`StdinMode`. The zero value is inactive.
+*/
+type Input struct {
+	Pty  *Pty
+	Pipe *Pipe
+}
+
+func (self Input) IsActive() bool { return self.Pty != nil || self.Pipe != nil }
+
+// Must be called after starting the subprocess.
+func (self Input) Start() {
+	if self.Pty != nil {
+		go self.Pty.Run()
+	}
+	if self.Pipe != nil {
+		self.Pipe.Start()
+	}
+}
+
+// Called if the subprocess failed to start.
+func (self Input) Abort() {
+	if self.Pty != nil {
+		self.Pty.Abort()
+	}
+	if self.Pipe != nil {
+		self.Pipe.Deinit()
+	}
+}
+
+// Called after the subprocess has exited.
+func (self Input) Deinit() {
+	if self.Pty != nil {
+		self.Pty.Deinit()
+	}
+	if self.Pipe != nil {
+		self.Pipe.Deinit()
+	}
+}
+
+func (self Input) Send(src []byte) {
+	if self.Pty != nil {
+		self.Pty.Send(src)
+	}
+	if self.Pipe != nil {
+		self.Pipe.Send(src)
+	}
+}
+
+/*
+Stdin pipe of one subprocess, used in raw mode when the subprocess doesn't have
+a PTY; see `StdinMode`. Each subprocess gets a new pipe, and sees the end of
+input only when it exits.
+*/
+type Pipe struct {
+	Read  *os.File
+	Write *os.File
+}
+
+func OpenPipe() (*Pipe, error) {
+	read, write, err := os.Pipe()
+	if err != nil {
+		return nil, gg.Wrap(err, `unable to open stdin pipe`)
+	}
+	return &Pipe{Read: read, Write: write}, nil
+}
+
+// Must be called before starting the command.
+func (self *Pipe) Attach(cmd *exec.Cmd) { cmd.Stdin = self.Read }
+
+// Must be called after starting the subprocess, which has its own copy.
+func (self *Pipe) Start() { gg.Nop1(self.Read.Close()) }
+
+// Closes both ends.
+func (self *Pipe) Deinit() {
+	gg.Nop1(self.Read.Close())
+	gg.Nop1(self.Write.Close())
+}
+
+// Forwards input to the subprocess, waiting up to `STDIN_WRITE_WAIT`.
+func (self *Pipe) Send(src []byte) { writeInput(self.Write, src) }
+
+func writeInput(out *os.File, src []byte) {
+	// Not supported by all files, in which case the write may block.
+	gg.Nop1(out.SetWriteDeadline(time.Now().Add(STDIN_WRITE_WAIT)))
+	gg.Nop2(out.Write(src))
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+How long `KeyDecoder` waits for the rest of an escape sequence. The escape key
+sends a lone ESC, which is also the first byte of the sequences of other keys.
+Terminals write each sequence at once, so the wait can be short.
+*/
+const KEY_ESC_WAIT = time.Millisecond * 50
+
+// Maximum length of an escape sequence. Longer input is treated as garbage.
+const KEY_SEQ_MAX = 32
+
+/*
+Splits terminal input into keys. A key is one of:
+
+  - A single byte, such as an ASCII character or control code.
+  - A UTF-8 rune.
+  - A CSI or SS3 escape sequence, such as "\x1b[A" for the up arrow, or
+    "\x1b[15;5~" for ctrl+f5.
+  - ESC followed by any of the above except sequences, sent by alt+<key>.
+
+Input may be split between reads. Incomplete keys stay buffered until the next
+call to `KeyDecoder.Decode`, or until `KeyDecoder.Flush`; see `Stdio.Run`.
+*/
+type KeyDecoder struct{ Buf []byte }
+
+// True if there's an incomplete key waiting for more input.
+func (self *KeyDecoder) IsPending() bool { return len(self.Buf) > 0 }
+
+func (self *KeyDecoder) Decode(src []byte) (out []string) {
+	self.Buf = append(self.Buf, src...)
+	var pos int
+
+	for pos < len(self.Buf) {
+		size := keyLen(self.Buf[pos:])
+		if size == 0 {
+			if len(self.Buf)-pos < KEY_SEQ_MAX {
+				break
+			}
+			size = len(self.Buf) - pos
+		}
+		out = append(out, string(self.Buf[pos:pos+size]))
+		pos += size
+	}
+
+	self.Buf = append(self.Buf[:0], self.Buf[pos:]...)
+	return
+}
+
+/*
+Returns the incomplete key as-is, as one key. Called when no more input arrives
+within `KEY_ESC_WAIT`, which usually means that the escape key was pressed.
+*/
+func (self *KeyDecoder) Flush() []string {
+	if !self.IsPending() {
+		return nil
+	}
+	out := string(self.Buf)
+	self.Buf = self.Buf[:0]
+	return []string{out}
+}
+
+// Length of the first key, or 0 if it's incomplete. See `KeyDecoder`.
+func keyLen(src []byte) int {
+	if src[0] != ASCII_ESCAPE {
+		return runeLen(src)
+	}
+	if len(src) < 2 {
+		return 0
+	}
+
+	switch src[1] {
+	case '[':
+		for ind := 2; ind < len(src); ind++ {
+			char := src[ind]
+
+			// Final byte.
+			if char >= 0x40 && char <= 0x7e {
+				return ind + 1
+			}
+
+			// Not a parameter or intermediate byte: malformed sequence.
+			if char < 0x20 || char > 0x3f {
+				return ind
+			}
+		}
+		return 0
+
+	case 'O':
+		if len(src) < 3 {
+			return 0
+		}
+		return 3
+
+	// The first ESC is the escape key.
+	case ASCII_ESCAPE:
+		return 1
+
+	default:
+		size := runeLen(src[1:])
+		if size == 0 {
+			return 0
+		}
+		return 1 + size
+	}
+}
+
+// Invalid UTF-8 is split into single bytes.
+func runeLen(src []byte) int {
+	if src[0] < utf8.RuneSelf {
+		return 1
+	}
+	if !utf8.FullRune(src) {
+		return 0
+	}
+	_, size := utf8.DecodeRune(src)
+	return size
+}
+
+/*
+Keys which send CSI or SS3 sequences. Sequences ending with a letter, such as
+"\x1b[A", use `.Final`, while sequences such as "\x1b[15~" use `.Code`. Some
+keys have both forms, or multiple codes, depending on the terminal. The first
+entry for each name is used for bindings; see `parseKey`.
+*/
+var SPECIAL_KEYS = []SpecialKey{
+	{`up`, 'A', ``},
+	{`down`, 'B', ``},
+	{`right`, 'C', ``},
+	{`left`, 'D', ``},
+	{`home`, 'H', `1`},
+	{`end`, 'F', `4`},
+	{`f1`, 'P', `11`},
+	{`f2`, 'Q', `12`},
+	{`f3`, 'R', `13`},
+	{`f4`, 'S', `14`},
+	{`insert`, 0, `2`},
+	{`delete`, 0, `3`},
+	{`pgup`, 0, `5`},
+	{`pgdn`, 0, `6`},
+	{`home`, 0, `7`},
+	{`end`, 0, `8`},
+	{`f5`, 0, `15`},
+	{`f6`, 0, `17`},
+	{`f7`, 0, `18`},
+	{`f8`, 0, `19`},
+	{`f9`, 0, `20`},
+	{`f10`, 0, `21`},
+	{`f11`, 0, `23`},
+	{`f12`, 0, `24`},
+}
+
+type SpecialKey struct {
+	Name  string
+	Final byte
+	Code  string
+}
+
+/*
+Modifiers of special keys, encoded in sequences as a parameter, which is 1
+plus a bitmask of these. Sequences of other keys have their own encoding of
+modifiers: ESC prefix for alt, and control codes for ctrl.
+*/
+const (
+	KEY_MOD_SHIFT = 1
+	KEY_MOD_ALT   = 2
+	KEY_MOD_CTRL  = 4
+)
+
+/*
+Human-readable name of a key, used for hotkey bindings, help, and logging.
+Keys which are sent differently by different terminals, such as "\x1b[H" and
+"\x1b[1~" for home, have the same name; see `Hotkeys.Get`. Inverse of
+`parseKey`.
+*/
+func keyName(key string) string {
+	if len(key) == 1 {
+		char := key[0]
+		switch {
+		case char == ASCII_ESCAPE:
+			return `esc`
+		case char == ASCII_DELETE:
+			return `^?`
+		case char < ' ':
+			return `^` + string(rune(char+'@'))
+		case char == ' ':
+			return `space`
+		case char >= utf8.RuneSelf:
+			return strconv.Quote(key)
+		default:
+			return key
+		}
+	}
+
+	name := seqKeyName(key)
+	if name != `` {
+		return name
+	}
+
+	if len(key) > 1 && key[0] == ASCII_ESCAPE && keyLen([]byte(key[1:])) == len(key)-1 && key[1] != ASCII_ESCAPE {
+		return `alt+` + keyName(key[1:])
+	}
+
+	if utf8.ValidString(key) && utf8.RuneCountInString(key) == 1 {
+		return key
+	}
+	return strconv.Quote(key)
+}
+
+// Returns "" if the key is not a known special key. See `SPECIAL_KEYS`.
+func seqKeyName(key string) string {
+	var params []string
+	var final byte
+
+	switch {
+	case len(key) == 3 && strings.HasPrefix(key, "\x1bO"):
+		final = key[2]
+
+	case len(key) > 2 && strings.HasPrefix(key, "\x1b["):
+		final = key[len(key)-1]
+		body := key[2 : len(key)-1]
+		if body != `` {
+			params = strings.Split(body, `;`)
+		}
+
+	default:
+		return ``
+	}
+
+	if final == 'Z' && params == nil {
+		return `shift+tab`
+	}
+
+	var found SpecialKey
+	if final == '~' {
+		if len(params) == 0 {
+			return ``
+		}
+		found = gg.Find(SPECIAL_KEYS, func(val SpecialKey) bool { return val.Code == params[0] })
+	} else {
+		if len(params) > 0 && params[0] != `1` {
+			return ``
+		}
+		found = gg.Find(SPECIAL_KEYS, func(val SpecialKey) bool { return val.Final == final })
+	}
+	if found.Name == `` || len(params) > 2 {
+		return ``
+	}
+
+	if len(params) < 2 {
+		return found.Name
+	}
+	num, err := strconv.Atoi(params[1])
+	if err != nil || num < 1 || num-1 > KEY_MOD_SHIFT|KEY_MOD_ALT|KEY_MOD_CTRL {
+		return ``
+	}
+	return keyModsPrefix(num-1) + found.Name
+}
+
+func keyModsPrefix(mods int) (out string) {
+	if mods&KEY_MOD_CTRL != 0 {
+		out += `ctrl+`
+	}
+	if mods&KEY_MOD_ALT != 0 {
+		out += `alt+`
+	}
+	if mods&KEY_MOD_SHIFT != 0 {
+		out += `shift+`
+	}
+	return
+}
+
+/*
+Parses a key for hotkey bindings. Returns the sequence which the key sends in
+most terminals. Supported formats:
+
+	^L           caret notation
+	12           decimal ASCII code, at least 2 digits
+	x            single character, including digits such as "1"
+	space, esc   named characters
+	f5, up       special keys; see `SPECIAL_KEYS`
+	ctrl+up      special keys with "ctrl+", "alt+", "shift+"
+	alt+x        alt with a character
+	ctrl+x       same as "^X"
+*/
+func parseKey(src string) (string, error) {
+	mods, base := splitKeyMods(src)
+
+	if mods == 0 {
+		out, ok := parseKeyChar(base)
+		if ok {
+			return out, nil
+		}
+	}
+
+	found := gg.Find(SPECIAL_KEYS, func(val SpecialKey) bool { return val.Name == strings.ToLower(base) })
+	if found.Name != `` {
+		return specialKeySeq(found, mods), nil
+	}
+	if strings.ToLower(base) == `tab` && mods == KEY_MOD_SHIFT {
+		return "\x1b[Z", nil
+	}
+
+	switch mods {
+	case KEY_MOD_ALT:
+		out, ok := parseKeyChar(base)
+		if ok && out[0] != ASCII_ESCAPE {
+			return "\x1b" + out, nil
+		}
+
+	case KEY_MOD_CTRL:
+		if len(base) == 1 {
+			out, ok := parseKeyChar(`^` + base)
+			if ok {
+				return out, nil
+			}
+		}
+	}
+
+	return ``, gg.Errf(`invalid hotkey %q; expected caret notation such as "^L", an ASCII code such as "12", a single character, or a key name such as "f5", "up", "ctrl+up", or "alt+x"`, src)
+}
+
+func parseKeyChar(src string) (string, bool) {
+	switch src {
+	case `space`:
+		return ` `, true
+	case `esc`:
+		return "\x1b", true
+	}
+
+	if len(src) == 2 && src[0] == '^' {
+		char := src[1]
+		if char == '?' {
+			return string(rune(ASCII_DELETE)), true
+		}
+		char = upperAscii(char)
+		if char >= '@' && char <= '_' {
+			return string(rune(char - '@')), true
+		}
+	}
+
+	// Single digits are characters, not codes.
+	if utf8.RuneCountInString(src) == 1 && src != string(utf8.RuneError) {
+		return src, true
+	}
+
+	num, err := strconv.ParseUint(src, 10, 7)
+	if err == nil {
+		return string(rune(num)), true
+	}
+	return ``, false
+}
+
+func splitKeyMods(src string) (mods int, base string) {
+	base = src
+	for {
+		head, tail, ok := strings.Cut(base, `+`)
+		if !ok || tail == `` {
+			return
+		}
+
+		switch strings.ToLower(head) {
+		case `ctrl`:
+			mods |= KEY_MOD_CTRL
+		case `alt`:
+			mods |= KEY_MOD_ALT
+		case `shift`:
+			mods |= KEY_MOD_SHIFT
+		default:
+			return
+		}
+		base = tail
+	}
+}
+
+func specialKeySeq(key SpecialKey, mods int) string {
+	var suf string
+	if mods != 0 {
+		suf = `;` + strconv.Itoa(mods+1)
+	}
+	if key.Final != 0 {
+		if mods != 0 {
+			return "\x1b[1" + suf + string(rune(key.Final))
+		}
+		return "\x1b[" + string(rune(key.Final))
+	}
+	return "\x1b[" + key.Code + suf + `~`
+}
+
+func upperAscii(char byte) byte {
+	if char >= 'a' && char <= 'z' {
+		return char - 'a' + 'A'
+	}
+	return char
+}
@@ -7,6 +7,8 @@ package main
 import (
 	l "log"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/mitranim/gg"
@@ -26,26 +28,36 @@ func main() {
 }
 
 type Main struct {
-	Opt         Opt
-	Cmd         Cmd
-	Stdio       Stdio
-	Watcher     Watcher
-	Term        Term
-	Sig         Sig
-	ChanRestart gg.Chan[struct{}]
-	ChanKill    gg.Chan[syscall.Signal]
-	Pid         int
+	Opt      Opt
+	Tasks    []*Task
+	Stdio    Stdio
+	Watcher  Watcher
+	Term     Term
+	Sig      Sig
+	Events   Events
+	Api      Api
+	Reload   Reload
+	ChanKill gg.Chan[syscall.Signal]
+	Pid      int
+	Paused   atomic.Bool
+	Verb     atomic.Bool
 }
 
 func (self *Main) Init() {
-	self.Opt.Init(os.Args[1:])
+	src := os.Args[1:]
+	self.Opt.Env = OptEnvSys()
+	self.Opt.Init(src)
+	self.Verb.Store(self.Opt.Verb)
+	self.Events.Init(self.Opt.Events)
 	self.Term.Init(self)
-	self.ChanRestart.Init()
 	self.ChanKill.Init()
-	self.Cmd.Init(self)
 	self.Sig.Init(self)
+	self.TasksInit(src)
+	self.Paused.Store(self.Opt.Paused)
 	self.WatchInit()
 	self.Stdio.Init(self)
+	self.Api.Init(self)
+	self.Reload.Init(self)
 }
 
 /*
@@ -63,56 +75,113 @@ We MUST call this manually before using `syscall.Kill` or `syscall.Exit` on the
 current process. Syscalls terminate the process bypassing Go `defer`.
 */
 func (self *Main) Deinit() {
+	self.Api.Deinit()
+	self.Reload.Deinit()
 	self.Stdio.Deinit()
 	self.Term.Deinit()
 	self.WatchDeinit()
 	self.Sig.Deinit()
-	self.Cmd.Deinit()
+	for _, task := range self.Tasks {
+		task.Deinit()
+	}
+	self.Events.Deinit()
 }
 
 func (self *Main) Run() {
+	for _, task := range self.Tasks {
+		go task.Run()
+	}
 	if self.Term.IsActive() {
 		go self.Stdio.Run()
 	}
 	go self.Sig.Run()
 	go self.WatchRun()
-	self.CmdRun()
+	if self.Api.IsActive() {
+		go self.Api.Run()
+	}
+	if self.Reload.IsActive() {
+		go self.Reload.Run()
+	}
+	self.kill(<-self.ChanKill)
+}
+
+/*
+Without profiles, or with one profile, there's only one task, which uses
+`Main.Opt`. With multiple profiles, each becomes a separate task, and
+`Main.Opt` provides only the shared settings such as `Opt.Raw`. See `Task`.
+
+The watcher watches the directories of all tasks.
+*/
+func (self *Main) TasksInit(src []string) {
+	if len(self.Opt.Profiles) <= 1 {
+		var task Task
+		task.Init(self, ``, self.Opt)
+		self.Tasks = []*Task{&task}
+		return
+	}
+
+	var dirs []string
+	for _, name := range self.Opt.Profiles {
+		var opt Opt
+		opt.Env = self.Opt.Env
+		opt.InitTask(src, name)
+
+		var task Task
+		task.Init(self, name, opt)
+		self.Tasks = append(self.Tasks, &task)
+		dirs = append(dirs, task.Opt.WatchDirs...)
+	}
+	self.Opt.WatchDirs = compactDirs(dirs)
+}
+
+func (self *Main) IsMultiTask() bool { return len(self.Tasks) > 1 }
+
+/*
+Directories watched by the watcher: `Opt.WatchDirs` of all tasks, and the local
+modules outside of them; see `Task.WatchDirs`.
+*/
+func (self *Main) WatchDirs() []string {
+	dirs := gg.Concat(self.Opt.WatchDirs)
+	for _, task := range self.Tasks {
+		dirs = append(dirs, task.Deps.OuterDirs()...)
+	}
+	return compactDirs(dirs)
 }
 
 func (self *Main) WatchInit() {
-	wat := new(WatchNotify)
+	var wat Watcher
+	switch self.Opt.Watch {
+	case WatchModeNotify:
+		wat = new(WatchNotify)
+	case WatchModePoll:
+		wat = new(WatchPoll)
+	default:
+		panic(self.Opt.Watch.errInvalid())
+	}
 	wat.Init(self)
 	self.Watcher = wat
 }
 
+/*
+The watcher is kept after deinit, because `Main.WatchSync` may be called
+concurrently from other goroutines. Watchers ignore syncing after deinit.
+*/
 func (self *Main) WatchDeinit() {
 	if self.Watcher != nil {
 		self.Watcher.Deinit()
-		self.Watcher = nil
 	}
 }
 
-func (self *Main) WatchRun() {
+// Called when `Main.WatchDirs` may have changed. See `Deps.SyncOuter`.
+func (self *Main) WatchSync() {
 	if self.Watcher != nil {
-		self.Watcher.Run()
+		self.Watcher.Sync()
 	}
 }
 
-func (self *Main) CmdRun() {
-	if !self.Opt.Postpone {
-		self.Cmd.Restart()
-	}
-
-	for {
-		select {
-		case <-self.ChanRestart:
-			self.Opt.TermInter()
-			self.Cmd.Restart()
-
-		case sig := <-self.ChanKill:
-			self.kill(sig)
-			return
-		}
+func (self *Main) WatchRun() {
+	if self.Watcher != nil {
+		self.Watcher.Run()
 	}
 }
 
@@ -127,22 +196,39 @@ func (self *Main) Exit() {
 }
 
 func (self *Main) OnFsEvent(event FsEvent) {
-	if !self.ShouldRestart(event) {
-		return
-	}
-	if self.Opt.Verb {
-		log.Println(`restarting on FS event:`, event)
+	for _, task := range self.Tasks {
+		task.OnFsEvent(event)
 	}
-	self.Restart()
 }
 
-func (self *Main) ShouldRestart(event FsEvent) bool {
-	return event != nil &&
-		!(self.Opt.Lazy && self.Cmd.IsRunning()) &&
-		self.Opt.AllowPath(event.Path())
+/*
+Used by watchers which walk directories by themselves, to skip directories
+ignored by every task. Assumes that the input is an absolute path.
+*/
+func (self *Main) AllowDir(path string) bool {
+	return gg.Some(self.Tasks, func(task *Task) bool { return task.Opt.AllowDir(path) })
 }
 
-func (self *Main) Restart() { self.ChanRestart.SendZeroOpt() }
+// Used by watchers which track individual files. See `Main.AllowDir`.
+func (self *Main) AllowPath(path string) bool {
+	return gg.Some(self.Tasks, func(task *Task) bool {
+		return task.Watches(path) && task.Opt.AllowPath(path)
+	})
+}
+
+// Manual restart of all tasks.
+func (self *Main) Restart() {
+	for _, task := range self.Tasks {
+		task.Restart()
+	}
+}
+
+// See `Cmd.Interrupt`.
+func (self *Main) Interrupt(sig syscall.Signal) {
+	for _, task := range self.Tasks {
+		task.Cmd.Interrupt(sig)
+	}
+}
 
 func (self *Main) Kill(val syscall.Signal) { self.ChanKill.SendOpt(val) }
 
@@ -150,11 +236,19 @@ func (self *Main) Kill(val syscall.Signal) { self.ChanKill.SendOpt(val) }
 func (self *Main) kill(sig syscall.Signal) {
 	/**
 	This should terminate any descendant processes, using their default behavior
-	for the given signal. If any misbehaving processes do not terminate on a
-	kill signal, this is out of our hands for now. We could use SIGKILL to
-	ensure termination, but it's unclear if we should.
+	for the given signal. Misbehaving processes which do not terminate within
+	`Opt.StopWait` are killed with SIGKILL. Tasks are stopped concurrently, so
+	that their waiting periods overlap.
 	*/
-	self.Cmd.Broadcast(sig)
+	var group sync.WaitGroup
+	for _, task := range self.Tasks {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			task.Stop(sig)
+		}()
+	}
+	group.Wait()
 
 	/**
 	This should restore previous terminal state and un-register our custom signal
@@ -172,6 +266,84 @@ func (self *Main) kill(sig syscall.Signal) {
 	gg.Nop1(syscall.Kill(os.Getpid(), sig))
 }
 
+/*
+Forwards input to running subprocesses, if any. Returns false if none of them
+accept input. See `Input`.
+*/
+func (self *Main) SendInput(src []byte) bool {
+	var ok bool
+	for _, task := range self.Tasks {
+		input := task.Cmd.GetInput()
+		if input.IsActive() {
+			input.Send(src)
+			ok = true
+		}
+	}
+	return ok
+}
+
+// True if any running subprocess accepts input. See `Main.SendInput`.
+func (self *Main) HasInput() bool {
+	return gg.Some(self.Tasks, func(task *Task) bool { return task.Cmd.GetInput().IsActive() })
+}
+
+// True if any running subprocess has a pseudo-terminal. See `Pty`.
+func (self *Main) HasPty() bool {
+	return gg.Some(self.Tasks, func(task *Task) bool { return task.Cmd.GetInput().Pty != nil })
+}
+
+// Called on SIGWINCH. See `Pty.Resize`.
+func (self *Main) ResizePty() {
+	for _, task := range self.Tasks {
+		pty := task.Cmd.GetInput().Pty
+		if pty != nil {
+			pty.Resize()
+		}
+	}
+}
+
+/*
+Verbose logging of `gow` itself, initially `Opt.Verb`. Each task has its own;
+see `Task.IsVerb`.
+*/
+func (self *Main) IsVerb() bool { return self.Verb.Load() }
+
+// Toggles verbose logging of `gow` and all tasks. Used via hotkeys.
+func (self *Main) ToggleVerbose() {
+	verb := !self.Verb.Load()
+	self.Verb.Store(verb)
+	for _, task := range self.Tasks {
+		task.Verb.Store(verb)
+	}
+	if verb {
+		log.Println(`verbose logging enabled`)
+	} else {
+		log.Println(`verbose logging disabled`)
+	}
+}
+
+// Used via hotkeys and SIGUSR1. See `Main.SetPaused`.
+func (self *Main) TogglePause() { self.SetPaused(!self.Paused.Load()) }
+
+/*
+Pauses or resumes watching. While paused, FS events don't cause restarts, but
+are recorded; see `Task.ShouldRestart` and `Task.Resume`. The subprocess keeps
+running, and manual restarts still work.
+*/
+func (self *Main) SetPaused(paused bool) {
+	if self.Paused.Swap(paused) == paused {
+		return
+	}
+	if paused {
+		log.Println(`watching paused`)
+		return
+	}
+	log.Println(`watching resumed`)
+	for _, task := range self.Tasks {
+		task.Resume()
+	}
+}
+
 func (self *Main) GetEchoMode() EchoMode {
 	if self.Term.IsActive() {
 		return self.Opt.Echo
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -14,35 +13,18 @@ import (
 const (
 	// These names reflect standard naming and meaning.
 	// Reference: https://en.wikipedia.org/wiki/Ascii.
-	// See our re-interpretation below.
+	// See our re-interpretation in `DEFAULT_KEYS`.
 	ASCII_END_OF_TEXT      = 3   // ^C
 	ASCII_BACKSPACE        = 8   // ^H
+	ASCII_DATA_LINK_ESCAPE = 16  // ^P
 	ASCII_FILE_SEPARATOR   = 28  // ^\
 	ASCII_DEVICE_CONTROL_2 = 18  // ^R
 	ASCII_DEVICE_CONTROL_4 = 20  // ^T
+	ASCII_ESCAPE           = 27  // ^[
 	ASCII_UNIT_SEPARATOR   = 31  // ^- or ^?
 	ASCII_DELETE           = 127 // ^H on MacOS
-
-	// These names reflect our re-interpretation of standard codes.
-	CODE_INTERRUPT        = ASCII_END_OF_TEXT
-	CODE_QUIT             = ASCII_FILE_SEPARATOR
-	CODE_RESTART          = ASCII_DEVICE_CONTROL_2
-	CODE_STOP             = ASCII_DEVICE_CONTROL_4
-	CODE_PRINT_COMMAND    = ASCII_UNIT_SEPARATOR
-	CODE_PRINT_HELP       = ASCII_BACKSPACE
-	CODE_PRINT_HELP_MACOS = ASCII_DELETE
 )
 
-const HOTKEY_HELP = `Control codes / hotkeys:
-
-	3     ^C          Kill subprocess with SIGINT. Repeat within 1s to kill gow.
-	18    ^R          Kill subprocess with SIGTERM, restart.
-	20    ^T          Kill subprocess with SIGTERM. Repeat within 1s to kill gow.
-	28    ^\          Kill subprocess with SIGQUIT. Repeat within 1s to kill gow.
-	31    ^- or ^?    Print currently running command.
-	8     ^H	  Print hotkey help.
-	127   ^H (MacOS)  Print hotkey help.`
-
 var (
 	NEWLINE      = "\n"
 	FD_TERM      = syscall.Stdin
@@ -69,16 +51,20 @@ func (self *Mained) Init(val *Main) { self.main = val }
 func (self *Mained) Main() *Main    { return self.main }
 
 /*
-Implemented by `notify.EventInfo`.
+Implemented by `notify.EventInfo` and `PollEvent`.
 Path must be an absolute filesystem path.
 */
 type FsEvent interface{ Path() string }
 
-// Implemented by `WatchNotify`.
+/*
+Implemented by `WatchNotify` and `WatchPoll`. Watchers watch `Main.WatchDirs`,
+and `.Sync` updates them when the directories change.
+*/
 type Watcher interface {
 	Init(*Main)
 	Deinit()
 	Run()
+	Sync()
 }
 
 func commaSplit(val string) []string {
@@ -88,14 +74,6 @@ func commaSplit(val string) []string {
 	return strings.Split(val, `,`)
 }
 
-func cleanExtension(val string) string {
-	ext := filepath.Ext(val)
-	if len(ext) > 0 && ext[0] == '.' {
-		return ext[1:]
-	}
-	return ext
-}
-
 func validateExtension(val string) {
 	if !RE_WORD.MatchString(val) {
 		panic(gg.Errf(`invalid extension %q`, val))
@@ -118,6 +96,39 @@ func toDirPath(val string) string {
 
 func toAbsDirPath(val string) string { return toDirPath(toAbsPath(val)) }
 
+// Converts an absolute path to a slash-separated path relative to CWD.
+func toRelSlashPath(val string) string {
+	rel, err := filepath.Rel(cwd, val)
+	if err != nil {
+		return filepath.ToSlash(val)
+	}
+	return filepath.ToSlash(rel)
+}
+
+/*
+Removes duplicates, and directories located inside other directories. Used for
+merging the watched directories of multiple tasks, since watching nested
+directories separately would duplicate FS events.
+*/
+func compactDirs(src []string) (out []string) {
+	abs := gg.Map(src, toAbsPath)
+
+	for ind, dir := range abs {
+		if !gg.Some(gg.Range(0, len(abs)), func(other int) bool {
+			if other == ind {
+				return false
+			}
+			if abs[other] == dir {
+				return other < ind
+			}
+			return isPathInside(dir, abs[other])
+		}) {
+			out = append(out, src[ind])
+		}
+	}
+	return
+}
+
 func toOsSignal[A os.Signal](src A) os.Signal { return src }
 
 func recLog() {
@@ -133,8 +144,3 @@ func withNewline[A ~string](val A) A {
 	}
 	return val + A(NEWLINE)
 }
-
-func writeByte[A io.Writer](tar A, char byte) (int, error) {
-	buf := [1]byte{char}
-	return tar.Write(gg.NoEscUnsafe(&buf)[:])
-}
@@ -3,9 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	l "log"
 	"os"
 	"os/exec"
-	"time"
+	"path/filepath"
+	r "reflect"
 
 	"github.com/mitranim/gg"
 	"golang.org/x/term"
@@ -17,29 +19,80 @@ If `false`, overrides raw mode.
 */
 var IsTty = term.IsTerminal(int(os.Stdin.Fd()))
 
-func OptDefault() Opt { return gg.FlagParseTo[Opt](nil) }
+func OptDefault() (out Opt) {
+	var par gg.FlagParser
+	par.Init(r.ValueOf(&out).Elem())
+	out.Default(par)
+	return
+}
 
 type Opt struct {
-	Args       []string         `flag:""`
-	Help       bool             `flag:"-h"                desc:"Print help and exit."`
-	Cmd        string           `flag:"-g"  init:"go"     desc:"Go tool to use."`
-	Verb       bool             `flag:"-v"                desc:"Verbose logging."`
-	ClearHard  bool             `flag:"-c"                desc:"Clear terminal on restart."`
-	ClearSoft  bool             `flag:"-s"                desc:"Soft-clear terminal, keeping scrollback."`
-	Raw        bool             `flag:"-r"                desc:"Enable hotkeys (via terminal raw mode)."`
-	Pre        FlagStrMultiline `flag:"-P"                desc:"Prefix printed BEFORE each run; multi; supports \\n."`
-	Suf        FlagStrMultiline `flag:"-S"                desc:"Suffix printed AFTER each run; multi; supports \\n."`
-	Trace      bool             `flag:"-t"                desc:"Print error trace on exit. Useful for debugging gow."`
-	Echo       EchoMode         `flag:"-re" init:"gow"    desc:"Stdin echoing in raw mode. Values: \"\" (none), \"gow\", \"preserve\"."`
-	Lazy       bool             `flag:"-l"                desc:"Lazy mode: restart only when subprocess is not running."`
-	Postpone   bool             `flag:"-p"                desc:"Postpone first run until FS event or manual ^R."`
-	Extensions FlagExtensions   `flag:"-e"  init:"go,mod" desc:"Extensions to watch; multi."`
-	WatchDirs  FlagWatchDirs    `flag:"-w"  init:"."      desc:"Directories to watch, relative to CWD; multi."`
-	IgnoreDirs FlagIgnoreDirs   `flag:"-i"                desc:"Ignored directories, relative to CWD; multi."`
+	Args          []string         `flag:""                   json:"args"`
+	Help          bool             `flag:"-h"                 json:"-"              desc:"Print help and exit."`
+	Cmd           string           `flag:"-g"  init:"go"      json:"cmd"            desc:"Go tool to use."`
+	Verb          bool             `flag:"-v"                 json:"verbose"        desc:"Verbose logging."`
+	ClearHard     bool             `flag:"-c"                 json:"clear"          desc:"Clear terminal on restart."`
+	ClearSoft     bool             `flag:"-s"                 json:"clear_soft"     desc:"Soft-clear terminal, keeping scrollback."`
+	Raw           bool             `flag:"-r"                 json:"raw"            desc:"Enable hotkeys (via terminal raw mode)."`
+	Pre           FlagStrMultiline `flag:"-P"                 json:"prefix"         desc:"Prefix printed BEFORE each run; multi; supports \\n."`
+	Suf           FlagStrMultiline `flag:"-S"                 json:"suffix"         desc:"Suffix printed AFTER each run; multi; supports \\n."`
+	Trace         bool             `flag:"-t"                 json:"trace"          desc:"Print error trace on exit. Useful for debugging gow."`
+	Echo          EchoMode         `flag:"-re" init:"gow"     json:"echo"           desc:"Stdin echoing in raw mode. Values: \"\" (none), \"gow\", \"preserve\"."`
+	Stdin         StdinMode        `flag:"-ri"                json:"stdin"          desc:"Forwarding of non-hotkey stdin in raw mode. Values: \"\" (none), \"pty\", \"pipe\", \"line\" (buffered)."`
+	Keys          FlagKeys         `flag:"--key"              json:"keys"           desc:"Hotkey binding in raw mode: \"<key>:<action>\", such as \"^L:clear\"; multi; empty action unbinds. See actions below."`
+	Lazy          bool             `flag:"-l"                 json:"lazy"           desc:"Lazy mode: restart only when subprocess is not running."`
+	Postpone      bool             `flag:"-p"                 json:"postpone"       desc:"Postpone first run until FS event or manual ^R."`
+	Paused        bool             `flag:"--paused"           json:"paused"         desc:"Start with watching paused; see \"toggle_pause\". The first run is not affected."`
+	ResumeRestart bool             `flag:"--resume-restart"   json:"resume_restart" desc:"When watching is resumed, restart once if any files changed while paused."`
+	Before        []string         `flag:"--before"           json:"before"         desc:"Shell command to run before the command, via \"sh -c\"; multi; steps run in order; a failed step aborts the run."`
+	Build         bool             `flag:"-b"                 json:"build"          desc:"Build mode for \"run\": build first, then replace the running program only if the build succeeds."`
+	Ready         FlagReady        `flag:"--ready"            json:"ready"          desc:"Readiness probe: \"tcp:<addr>\", \"http://<url>\" (2xx), or \"log:<regexp>\" (stdout/stderr); multi; used by \"--reload\" and \"-S\"."`
+	ReadyTimeout  FlagDuration     `flag:"-rt" init:"30s"     json:"ready_timeout"  desc:"Timeout of \"--ready\" probes. \"0\" means no limit."`
+	StopSig       FlagSignal       `flag:"-ss" init:"SIGTERM" json:"stop_signal"    desc:"Signal for stopping the subprocess before restarting or exiting."`
+	StopWait      FlagDuration     `flag:"-sw" init:"5s"      json:"stop_wait"      desc:"How long to wait for the subprocess to stop before using SIGKILL. \"0\" disables waiting."`
+	RestartMode   RestartMode      `flag:"--restart"          json:"restart"        desc:"Restart the subprocess when it exits on its own. Values: \"never\", \"on-failure\", \"always\"."`
+	RestartDelay  FlagDuration     `flag:"-rd" init:"1s"      json:"restart_delay"  desc:"Delay of restarts caused by \"--restart\"."`
+	RestartMax    int              `flag:"-rn"                json:"restart_max"    desc:"Maximum consecutive restarts caused by \"--restart\"; a run lasting \"-rw\" resets the count. \"0\" means unlimited."`
+	RestartWindow FlagDuration     `flag:"-rw" init:"10s"     json:"restart_window" desc:"A run lasting this long resets the count of consecutive restarts for \"-rn\". \"0\" resets after every run."`
+	BackoffFails  int              `flag:"-bn"                json:"backoff_fails"  desc:"Crash-loop detection: after this many failures within \"-bw\", delay automatic restarts. \"0\" disables."`
+	BackoffWindow FlagDuration     `flag:"-bw" init:"10s"     json:"backoff_window" desc:"Time window for counting failures for \"-bn\"."`
+	BackoffDelay  FlagDuration     `flag:"-bd" init:"1s"      json:"backoff_delay"  desc:"Initial delay of automatic restarts in a crash loop; doubles on each further failure."`
+	BackoffMax    FlagDuration     `flag:"-bm" init:"1m"      json:"backoff_max"    desc:"Maximum delay of automatic restarts in a crash loop."`
+	Debounce      FlagDuration     `flag:"-d"                 json:"debounce"       desc:"Merge FS events arriving within this window into one restart. Example: \"-d=50ms\"."`
+	DebounceMax   FlagDuration     `flag:"-dm" init:"1s"      json:"debounce_max"   desc:"Maximum delay of a merged restart, counting from the first FS event."`
+	Extensions    FlagExtensions   `flag:"-e"  init:"go,mod"  json:"extensions"     desc:"Extensions to watch; multi; shorthand for \"--include=**/*.<ext>\"."`
+	Include       FlagInclude      `flag:"--include"          json:"include"        desc:"Glob of files to watch, relative to CWD, supports \"**\"; multi."`
+	Exclude       FlagExclude      `flag:"--exclude"          json:"exclude"        desc:"Glob of files to ignore, relative to CWD, supports \"**\"; multi."`
+	WatchDirs     FlagWatchDirs    `flag:"-w"  init:"."       json:"watch"          desc:"Directories to watch, relative to CWD; multi."`
+	IgnoreDirs    FlagIgnoreDirs   `flag:"-i"                 json:"ignore"         desc:"Ignored directories, relative to CWD; multi."`
+	Deps          bool             `flag:"-wd"                json:"deps"           desc:"Watch only packages which the target depends on, via \"go list -deps\"."`
+	TestAffected  bool             `flag:"-ta"                json:"test_affected"  desc:"With \"test\": on FS events, test only affected packages. ^R tests all."`
+	GitIgnore     bool             `flag:"-ig"                json:"gitignore"      desc:"Respect \".gitignore\" files. \".gowignore\" files are always respected."`
+	Watch         WatchMode        `flag:"-wm" init:"notify"  json:"watcher"        desc:"Watcher implementation. Values: \"notify\" (native FS events), \"poll\"."`
+	PollDelay     FlagDuration     `flag:"-wp" init:"1s"      json:"poll_delay"     desc:"Interval between directory scans in polling mode."`
+	Api           string           `flag:"--api"              json:"api"            desc:"Serve the control API on a unix socket path, or \"tcp:<addr>\" on localhost."`
+	Proxy         string           `flag:"--proxy"            json:"proxy"          desc:"Serve a reverse proxy to \"--proxy-to\" on this localhost address; holds requests during restarts."`
+	ProxyTo       string           `flag:"--proxy-to"         json:"proxy_to"       desc:"Address of the server of the subprocess, for \"--proxy\", such as \"localhost:8080\"."`
+	Reload        string           `flag:"--reload"           json:"reload"         desc:"Serve browser live-reload via SSE on this localhost address, such as \":35729\"; requires \"--ready\"."`
+	Events        string           `flag:"--events"           json:"events"         desc:"Write lifecycle events as NDJSON to a file path, \"fd:<num>\", or \"unix:<path>\"."`
+
+	// Not flags. Initialized when parsing; see `Opt.ParseArgs`.
+	PathRules []PathRule `json:"-"`
+
+	// Not flags. Initialized in `Opt.Init`.
+	IgnoreFiles *IgnoreFiles `json:"-"`
+	Sources     OptSources   `json:"-"`
+	Profiles    []string     `json:"-"`
+
+	// Not a flag. Set by `Task` to prefix logs. See `Opt.Logger`.
+	Log *l.Logger `json:"-"`
+
+	// Not a flag. Set before `Opt.Init` to use env vars and the config file.
+	Env OptEnv `json:"-"`
 }
 
 func (self *Opt) Init(src []string) {
-	err := gg.FlagParseCatch(src, self)
+	err := self.Parse(src)
 	if err != nil {
 		self.LogErr(err)
 		gg.Write(log.Writer(), NEWLINE)
@@ -52,11 +105,14 @@ func (self *Opt) Init(src []string) {
 		os.Exit(0)
 	}
 
-	if gg.IsEmpty(self.Args) {
+	if gg.IsEmpty(self.Args) && len(self.Profiles) <= 1 {
 		self.PrintHelp()
 		os.Exit(1)
 	}
 
+	self.InitFilters()
+	self.Validate()
+
 	if self.Raw && !IsTty {
 		self.Raw = false
 		if self.Verb {
@@ -65,6 +121,178 @@ func (self *Opt) Init(src []string) {
 	}
 }
 
+/*
+Initializes the options of one of multiple concurrent tasks, using the given
+profile from the config file. See `Task`.
+*/
+func (self *Opt) InitTask(src []string, profile string) {
+	err := gg.Catch(func() { self.ParseProfile(src, profile) })
+	if err != nil {
+		panic(gg.Wrapf(err, `unable to initialize task %q`, profile))
+	}
+	if gg.IsEmpty(self.Args) {
+		panic(gg.Errf(`unable to initialize task %q: missing "args" in profile`, profile))
+	}
+	self.InitFilters()
+	self.Validate()
+}
+
+func (self *Opt) InitFilters() {
+	self.IgnoreFiles = new(IgnoreFiles)
+	self.IgnoreFiles.Init(self.GitIgnore)
+}
+
+func (self Opt) Validate() {
+	if self.Build && gg.IsNotEmpty(self.Args) && ParseGoArgs(self.Args).Sub != `run` {
+		panic(gg.Errf(`build mode "-b" requires the "run" subcommand, got args %q`, self.Args))
+	}
+	if self.Proxy != `` && self.ProxyTo == `` {
+		panic(gg.Errf(`proxy "--proxy" requires the target address "--proxy-to"`))
+	}
+}
+
+/*
+Parses CLI args. With multiple "@profile" args, the result contains only the
+shared settings, and the profiles are stored in `Opt.Profiles`, to be used by
+`Opt.InitTask`. Multiple profiles can't be combined with CLI positional args,
+since each profile must provide its own.
+*/
+func (self *Opt) Parse(src []string) (err error) {
+	defer gg.Rec(&err)
+
+	profiles, args := splitProfiles(cliOpt(src).Args)
+	if len(profiles) > 1 && gg.IsNotEmpty(args) {
+		panic(gg.Errf(`unexpected args %q: multiple profiles %q must provide their own "args"`, args, profiles))
+	}
+
+	if len(profiles) == 1 {
+		self.ParseProfile(src, profiles[0])
+	} else {
+		self.ParseProfile(src, ``)
+	}
+	self.Profiles = profiles
+	return
+}
+
+/*
+Parses the args, recording the order of extensions, includes, and excludes into
+`Opt.PathRules`; see `Opt.AllowFile`. The flags append to it by themselves; see
+`FlagPathRules`.
+*/
+func (self *Opt) ParseArgs(par gg.FlagParser, src []string) {
+	self.BindPathRules(&self.PathRules)
+	defer self.BindPathRules(nil)
+	par.Args(src)
+}
+
+/*
+Points the path rule flags at the given list. Used with `Opt.PathRules` for the
+duration of parsing, and with nil afterwards, so that copies of `Opt` don't
+refer to this one.
+*/
+func (self *Opt) BindPathRules(tar *[]PathRule) {
+	self.Extensions.Rules = tar
+	self.Include.Rules = tar
+	self.Exclude.Rules = tar
+}
+
+/*
+Parses the args of a source with a higher priority than the previously parsed
+args, such as env vars after the config file. Its path rules are inserted
+before the first exclude of the lower sources, which means that extensions and
+includes can't re-include the files excluded by a lower source. Within each
+source, path rules keep their order. Passing "--exclude" in a higher source
+replaces the excludes of lower sources, like with other multi flags; see
+`dropFlags`.
+*/
+func (self *Opt) LayerArgs(par gg.FlagParser, src []string) {
+	base := self.PathRules
+	self.PathRules = nil
+	self.ParseArgs(par, src)
+
+	ind := gg.FindIndex(base, PathRule.IsExclude)
+	if ind < 0 {
+		ind = len(base)
+	}
+	self.PathRules = gg.Concat(base[:ind], self.PathRules, base[ind:])
+}
+
+/*
+Applies the defaults of the flags which were not passed. The default extensions
+go before other path rules, which allows excludes to override them.
+*/
+func (self *Opt) Default(par gg.FlagParser) {
+	self.BindPathRules(&self.PathRules)
+	defer self.BindPathRules(nil)
+
+	size := len(self.PathRules)
+	par.Default()
+	self.PathRules = gg.Concat(self.PathRules[size:], self.PathRules[:size])
+}
+
+func cliOpt(src []string) (out Opt) {
+	var par gg.FlagParser
+	par.Init(r.ValueOf(&out).Elem())
+	par.Args(src)
+	return
+}
+
+/*
+Parses CLI args, combining them with environment variables and the config file,
+if any; see `Opt.Env`, `EnvFlags` and `Config`. In order of increasing priority: built-in
+defaults, config file, environment variables, CLI flags. Positional args from
+the CLI, after any "@profile" args, replace the args from the config file.
+An empty profile selects only the top-level keys of the config file.
+*/
+func (self *Opt) ParseProfile(src []string, profile string) {
+	var cli Opt
+	var cliPar gg.FlagParser
+	cliPar.Init(r.ValueOf(&cli).Elem())
+	cliPar.Args(src)
+
+	sources := OptSources{}
+	for key := range cliPar.Got {
+		sources[key] = OptSourceCli
+	}
+
+	env := dropFlags(self.Env.Flags(), cliPar.Got)
+	sources.Add(env, OptSourceEnv)
+
+	_, args := splitProfiles(cli.Args)
+
+	conf := self.Env.Config()
+	if conf == nil && profile != `` {
+		panic(gg.Errf(`unable to use profile %q: no config file %q in CWD or its parents`, profile, CONFIG_FILE))
+	}
+
+	var flags []string
+	if conf != nil {
+		var confArgs []string
+		flags, confArgs = conf.Flags(conf.Opt(profile))
+		flags = dropFlags(flags, gg.SetOf(gg.MapKeys(sources)...))
+		sources.Add(flags, OptSourceConfig)
+		if gg.IsEmpty(args) {
+			args = confArgs
+		}
+	}
+
+	var par gg.FlagParser
+	par.Init(r.ValueOf(self).Elem())
+	self.ParseArgs(par, flags)
+	self.LayerArgs(par, env)
+	self.LayerArgs(par, src)
+	self.Default(par)
+	self.Args = args
+	self.Sources = sources
+
+	if self.Verb {
+		if conf != nil {
+			log.Printf(`using config file %q, profile %q`, conf.Path, profile)
+		}
+		log.Printf("effective options:\n%v", self.FmtSources())
+	}
+}
+
 func (self Opt) PrintHelp() {
 	gg.FlagFmtDefault.Prefix = "\t"
 	gg.FlagFmtDefault.Head = false
@@ -93,6 +321,11 @@ Flags:
 "Multi" flags can be passed multiple times.
 Some also support comma-separated parsing.
 
+Flags can also be set via environment variables or a "gow.json" config file.
+Effective values and their sources, in order of increasing priority: default,
+config, env, cli:
+
+%v
 When using "gow" in an interactive terminal, enable hotkey support via "-r".
 The flag stands for "raw mode". Avoid this in non-interactive environments,
 or when running multiple "gow" concurrently in the same terminal. Examples:
@@ -101,39 +334,37 @@ or when running multiple "gow" concurrently in the same terminal. Examples:
 	gow -v -r run .
 
 %v
-`, gg.FlagHelp[Opt](), HOTKEY_HELP))
+
+%v
+`, gg.FlagHelp[Opt](), self.FmtSources(), NewHotkeys(self.Keys).Help(), actionsHelp()))
+}
+
+// Returns `Opt.Log`, falling back on the global logger.
+func (self Opt) Logger() *l.Logger {
+	if self.Log != nil {
+		return self.Log
+	}
+	return log
 }
 
 func (self Opt) LogErr(err error) {
 	if err != nil {
 		if self.Trace {
-			log.Printf(`%+v`, err)
+			self.Logger().Printf(`%+v`, err)
 		} else {
-			log.Println(err)
+			self.Logger().Println(err)
 		}
 	}
 }
 
-func (self Opt) LogCmdExit(err error, dur time.Duration) {
-	if err == nil {
-		if self.Verb {
-			log.Printf(`subprocess done in %v`, dur)
-		}
-		return
-	}
-
-	if self.Verb || !self.ShouldSkipErr(err) {
-		log.Printf(`subprocess error after %v: %v`, dur, err)
-	}
-}
-
 /*
 `go run` reports exit code to stderr. `go test` reports test failures.
 In those cases, we suppress the "exit code" error to avoid redundancy.
+In build mode, the program runs directly, and nothing reports its exit code.
 */
 func (self Opt) ShouldSkipErr(err error) bool {
 	head := gg.Head(self.Args)
-	return (head == `run` || head == `test`) && errors.As(err, new(*exec.ExitError))
+	return ((head == `run` && !self.Build) || head == `test`) && errors.As(err, new(*exec.ExitError))
 }
 
 func (self Opt) TermPre() { self.Pre.Dump(log.Writer()) }
@@ -155,5 +386,33 @@ func (self Opt) TermClear() {
 }
 
 func (self Opt) AllowPath(path string) bool {
-	return self.Extensions.Allow(path) && self.IgnoreDirs.Allow(path)
+	return self.AllowFile(path) &&
+		self.IgnoreDirs.Allow(path) &&
+		self.IgnoreFiles.Allow(path, false)
+}
+
+/*
+Decides whether the file is watched, considering extensions, includes, and
+excludes, which are evaluated in the order in which they were passed; each
+extension is a shorthand for an include. The last matching rule wins. When
+there are no includes, files are watched unless excluded.
+*/
+func (self Opt) AllowFile(path string) bool {
+	allow := !gg.Some(self.PathRules, PathRule.IsInclude)
+	rel, abs := toRelSlashPath(path), filepath.ToSlash(path)
+	for _, rule := range self.PathRules {
+		if rule.Match(rel, abs) {
+			allow = !rule.Exclude
+		}
+	}
+	return allow
+}
+
+/*
+Used by watchers which walk directories by themselves, to skip ignored
+directories entirely. Assumes that the input is an absolute path.
+*/
+func (self Opt) AllowDir(path string) bool {
+	return self.IgnoreDirs.Allow(toDirPath(path)) &&
+		self.IgnoreFiles.Allow(path, true)
 }
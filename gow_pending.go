@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Accumulates the causes of the next restart. Restart requests are sent over
+`Task.ChanRestart` without blocking, and may be dropped while a restart is
+already in progress; the causes are kept here until the next restart takes
+them.
+*/
+type Pending struct {
+	Lock   sync.Mutex
+	Paths  gg.OrdSet[string]
+	Manual bool
+}
+
+func (self *Pending) AddPaths(paths ...string) {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Paths.Add(paths...)
+}
+
+func (self *Pending) SetManual() {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Manual = true
+}
+
+func (self *Pending) IsManual() bool {
+	defer gg.Lock(&self.Lock).Unlock()
+	return self.Manual
+}
+
+// Returns the accumulated causes and resets the state.
+func (self *Pending) Take() (paths []string, manual bool) {
+	defer gg.Lock(&self.Lock).Unlock()
+	paths, manual = self.Paths.Slice, self.Manual
+	self.Paths.Clear()
+	self.Manual = false
+	return
+}
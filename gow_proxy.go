@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Optional reverse proxy in front of the subprocess, enabled via `Opt.Proxy`.
+Listens on a stable port, and forwards to `Opt.ProxyTo`. While the subprocess
+is restarting or not yet ready, incoming requests are held rather than failing
+with "connection refused"; see `Cmd.AwaitReady`. When the last build or
+before-step failed, or the subprocess exited on its own, requests get a page
+with the error and the tail of stderr.
+
+In build mode, a failed build doesn't affect the proxy: the previous
+subprocess keeps running, and requests are still forwarded to it. The error
+page is served only when there's nothing to forward to. See `Opt.Build`.
+
+Requests are held for up to `Opt.ReadyTimeout`. Each task may have its own
+proxy.
+
+`.Enabled` is set once by `Proxy.Init`, and may be read by any goroutine
+without locking, unlike `.Listener`, which is owned by `Proxy.Run`.
+*/
+type Proxy struct {
+	Tasked
+	Enabled  bool
+	Lock     sync.Mutex
+	Gate     gg.Chan[struct{}]
+	Fail     *ProxyFail
+	Listener net.Listener
+	Server   http.Server
+	Rev      httputil.ReverseProxy
+}
+
+// Why the proxy serves an error page instead of forwarding requests.
+type ProxyFail struct {
+	Desc string
+	Out  string
+}
+
+func (self *Proxy) Init(task *Task) {
+	self.Tasked.Init(task)
+	opt := task.Opt
+	if opt.Proxy == `` {
+		return
+	}
+
+	target, err := url.Parse(`http://` + opt.ProxyTo)
+	if err != nil {
+		panic(gg.Wrapf(err, `invalid proxy target %q`, opt.ProxyTo))
+	}
+
+	lis, err := listenLoopback(opt.Proxy)
+	if err != nil {
+		panic(gg.Wrapf(err, `unable to start proxy on %q`, opt.Proxy))
+	}
+
+	self.Gate.Init()
+	self.Enabled = true
+	self.Listener = lis
+	self.Server.Handler = self
+	self.Rev.Rewrite = func(req *httputil.ProxyRequest) {
+		req.SetURL(target)
+		req.SetXForwarded()
+		req.Out.Host = req.In.Host
+	}
+	self.Rev.Transport = &http.Transport{DialContext: self.dial}
+	self.Rev.ErrorHandler = self.OnErr
+
+	if task.IsVerb() {
+		opt.Logger().Printf(`proxy listening on %q, forwarding to %q`, lis.Addr(), opt.ProxyTo)
+	}
+}
+
+func (self *Proxy) Deinit() {
+	if self.Enabled {
+		gg.Nop1(self.Server.Close())
+	}
+}
+
+func (self *Proxy) IsActive() bool { return self.Enabled }
+
+func (self *Proxy) Run() {
+	err := self.Server.Serve(self.Listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		self.Task().Opt.Logger().Println(`proxy error:`, err)
+	}
+}
+
+// Holds incoming requests. Called when the subprocess is stopped or started.
+func (self *Proxy) Pause() {
+	if !self.IsActive() {
+		return
+	}
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Fail = nil
+	if isChanClosed(self.Gate) {
+		self.Gate = make(gg.Chan[struct{}])
+	}
+}
+
+// Releases held requests. Called when the subprocess is ready.
+func (self *Proxy) Resume() { self.release(nil) }
+
+// Releases held requests, serving them an error page.
+func (self *Proxy) OnFail(desc, out string) {
+	self.release(&ProxyFail{Desc: desc, Out: out})
+}
+
+func (self *Proxy) release(fail *ProxyFail) {
+	if !self.IsActive() {
+		return
+	}
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Fail = fail
+	if !isChanClosed(self.Gate) {
+		close(self.Gate)
+	}
+}
+
+func (self *Proxy) state() (gg.Chan[struct{}], *ProxyFail) {
+	defer gg.Lock(&self.Lock).Unlock()
+	return self.Gate, self.Fail
+}
+
+func (self *Proxy) ServeHTTP(rew http.ResponseWriter, req *http.Request) {
+	gate, _ := self.state()
+	timeout := self.timeout()
+
+	select {
+	case <-gate:
+	case <-req.Context().Done():
+		return
+	case <-timeout:
+		self.ServeFail(rew, http.StatusGatewayTimeout, ProxyFail{
+			Desc: `subprocess not ready after ` + self.Task().Opt.ReadyTimeout.String(),
+		})
+		return
+	}
+
+	_, fail := self.state()
+	if fail != nil {
+		self.ServeFail(rew, http.StatusBadGateway, *fail)
+		return
+	}
+	self.Rev.ServeHTTP(rew, req)
+}
+
+func (self *Proxy) OnErr(rew http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() != nil {
+		return
+	}
+	_, fail := self.state()
+	if fail == nil {
+		fail = &ProxyFail{Desc: `unable to reach ` + self.Task().Opt.ProxyTo + `: ` + err.Error()}
+	}
+	self.ServeFail(rew, http.StatusBadGateway, *fail)
+}
+
+/*
+The subprocess may be ready before it listens, for example without readiness
+probes, so refused connections are retried until the timeout, or until the
+subprocess fails.
+*/
+func (self *Proxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	timeout := self.timeout()
+
+	for {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) {
+			return conn, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-timeout:
+			return nil, err
+		case <-time.After(READY_POLL_DELAY):
+		}
+
+		_, fail := self.state()
+		if fail != nil {
+			return nil, err
+		}
+	}
+}
+
+// Nil channel means no timeout.
+func (self *Proxy) timeout() <-chan time.Time {
+	val := self.Task().Opt.ReadyTimeout.Duration()
+	if val > 0 {
+		return time.After(val)
+	}
+	return nil
+}
+
+func (self *Proxy) ServeFail(rew http.ResponseWriter, code int, fail ProxyFail) {
+	var script string
+	main := self.Task().Main()
+	if main != nil && main.Reload.IsActive() {
+		script = `<script src="http://` + main.Reload.Listener.Addr().String() + `/reload.js"></script>`
+	}
+
+	head := rew.Header()
+	head.Set(`Content-Type`, `text/html; charset=utf-8`)
+	head.Set(`Cache-Control`, `no-store`)
+	rew.WriteHeader(code)
+	gg.Nop2(fmt.Fprintf(rew, PROXY_FAIL_PAGE, html.EscapeString(fail.Desc), html.EscapeString(fail.Out), script))
+}
+
+const PROXY_FAIL_PAGE = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gow: error</title>
+<style>
+body {margin: 0; padding: 2rem; background: #1e1e1e; color: #ddd; font: 14px/1.5 system-ui, sans-serif}
+h1 {margin: 0 0 1rem; color: #f66; font-size: 1.25rem}
+pre {margin: 0; padding: 1rem; background: #111; border-radius: 4px; overflow: auto; font: 13px/1.5 ui-monospace, monospace; white-space: pre-wrap}
+pre:empty {display: none}
+</style>
+</head>
+<body>
+<h1>%v</h1>
+<pre>%v</pre>
+%v
+</body>
+</html>
+`
+
+/*
+Returns nil if the proxy is inactive. Otherwise returns a writer which keeps
+the tail of the output, for the error page. See `Proxy.OnFail`.
+*/
+func (self *Proxy) NewTail() *TailBuf {
+	if !self.IsActive() {
+		return nil
+	}
+	return &TailBuf{Max: PROXY_TAIL_MAX}
+}
+
+// Maximum size of the output shown on the error page of `Proxy`.
+const PROXY_TAIL_MAX = 1 << 16
+
+// Keeps the last `.Max` bytes written to it.
+type TailBuf struct {
+	Lock sync.Mutex
+	Max  int
+	Buf  []byte
+}
+
+func (self *TailBuf) Write(src []byte) (int, error) {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Buf = append(self.Buf, src...)
+	if len(self.Buf) > self.Max {
+		self.Buf = append(self.Buf[:0], self.Buf[len(self.Buf)-self.Max:]...)
+	}
+	return len(src), nil
+}
+
+// Nil-safe.
+func (self *TailBuf) String() string {
+	if self == nil {
+		return ``
+	}
+	defer gg.Lock(&self.Lock).Unlock()
+	return string(self.Buf)
+}
+
+func isChanClosed[A any](src chan A) bool {
+	select {
+	case _, ok := <-src:
+		return !ok
+	default:
+		return false
+	}
+}
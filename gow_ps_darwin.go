@@ -3,22 +3,19 @@
 package main
 
 import (
-	"os"
-
 	"github.com/mitranim/gg"
 	"golang.org/x/sys/unix"
 )
 
 func SubPids(topPid int, verb bool) ([]int, error) {
-	pid := os.Getpid()
-	pids, err := SubPidsViaSyscall(pid)
+	pids, err := SubPidsViaSyscall(topPid)
 	if err == nil {
 		return pids, nil
 	}
 	if verb {
 		log.Println(`unable to get pids via syscall, falling back on "ps":`, err)
 	}
-	return SubPidsViaPs(pid)
+	return SubPidsViaPs(topPid)
 }
 
 func SubPidsViaSyscall(topPid int) ([]int, error) {
@@ -12,15 +12,14 @@ import (
 )
 
 func SubPids(topPid int, verb bool) ([]int, error) {
-	pid := os.Getpid()
-	pids, err := SubPidsViaProcDir(pid)
+	pids, err := SubPidsViaProcDir(topPid)
 	if err == nil {
 		return pids, nil
 	}
 	if verb {
 		log.Println(`unable to get pids from "/proc", falling back on "ps":`, err)
 	}
-	return SubPidsViaPs(pid)
+	return SubPidsViaPs(topPid)
 }
 
 func SubPidsViaProcDir(topPid int) ([]int, error) {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/mitranim/gg"
+	"golang.org/x/sys/unix"
+)
+
+/*
+How long `Pty.Deinit` waits for the remaining output after the subprocess has
+exited. Descendants which outlive the subprocess may keep the PTY open, and we
+don't wait for them.
+*/
+const PTY_DRAIN_WAIT = time.Millisecond * 100
+
+/*
+Pseudo-terminal of one subprocess. Used in raw mode, where our own stdin is
+reserved for hotkeys; see `Term`. Without a PTY, the subprocess would have no
+stdin, and its stdout and stderr would not be terminals, which disables colors,
+progress bars, and interactive prompts in many programs.
+
+The subprocess gets the slave side as its stdin, stdout, stderr, and
+controlling terminal. We copy the output from the master side to our stdout,
+and write the input which is not a hotkey to the master; see
+`Stdio.OnInput`. Echoing and line editing of that input is performed by the
+PTY according to the settings of the subprocess, which allows programs to
+disable echoing for passwords, or to read input byte by byte. The window size
+is copied from our terminal, initially and on SIGWINCH; see `Pty.Resize`.
+
+Since both stdout and stderr of the subprocess are written to the PTY, the
+output goes to our stdout.
+*/
+type Pty struct {
+	Master *os.File
+	Slave  *os.File
+	Out    io.Writer
+	Done   gg.Chan[struct{}]
+}
+
+func OpenPty(out io.Writer) (*Pty, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, gg.Wrap(err, `unable to open pseudo-terminal`)
+	}
+
+	val := &Pty{Master: master, Slave: slave, Out: out}
+	val.Done.Init()
+	val.Resize()
+	return val, nil
+}
+
+// Makes the given command use the PTY. Must be called before starting it.
+func (self *Pty) Attach(cmd *exec.Cmd) {
+	cmd.Stdin = self.Slave
+	cmd.Stdout = self.Slave
+	cmd.Stderr = self.Slave
+
+	/**
+	The subprocess must be the leader of a new session in order to acquire
+	the PTY as its controlling terminal. The field `Ctty` refers to a file
+	descriptor in the subprocess, which is its stdin.
+
+	This doesn't interfere with our signal broadcasting, which relies on the
+	process tree rather than process groups. See `Cmd.Broadcast`.
+	*/
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+}
+
+/*
+Must be called after starting the subprocess. Our copy of the slave side must
+be closed, otherwise reading from the master would never end.
+*/
+func (self *Pty) Run() {
+	defer self.Done.Close()
+	gg.Nop1(self.Slave.Close())
+
+	/**
+	On Linux, reading from the master fails with EIO once every process holding
+	the slave side has exited, which is the expected end of the output.
+	*/
+	_, err := io.Copy(self.Out, self.Master)
+	if err != nil && !errors.Is(err, syscall.EIO) && !errors.Is(err, os.ErrClosed) {
+		log.Println(`error when reading from pseudo-terminal:`, err)
+	}
+}
+
+/*
+Called after the subprocess has exited. Waits for the remaining output, up to
+`PTY_DRAIN_WAIT`, then closes the PTY.
+*/
+func (self *Pty) Deinit() {
+	select {
+	case <-self.Done:
+	case <-time.After(PTY_DRAIN_WAIT):
+	}
+	gg.Nop1(self.Master.Close())
+}
+
+// Called if the subprocess failed to start.
+func (self *Pty) Abort() {
+	gg.Nop1(self.Slave.Close())
+	gg.Nop1(self.Master.Close())
+}
+
+// Forwards input to the subprocess, waiting up to `STDIN_WRITE_WAIT`.
+func (self *Pty) Send(src []byte) { writeInput(self.Master, src) }
+
+/*
+Copies the window size of our terminal to the PTY. The kernel notifies the
+subprocess via SIGWINCH.
+
+Note: we avoid `os.File.Fd`, which would switch the master to blocking mode.
+*/
+func (self *Pty) Resize() {
+	size, err := unix.IoctlGetWinsize(FD_TERM, unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+
+	conn, err := self.Master.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	gg.Nop1(conn.Control(func(fd uintptr) {
+		gg.Nop1(unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, size))
+	}))
+}
@@ -0,0 +1,69 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+Like on Linux, the master is non-blocking, which allows the Go runtime to poll
+it, and allows `Pty.Deinit` to interrupt a pending read by closing it. If the
+runtime is unable to poll it, which is the case with kqueue on some older
+versions of MacOS, we fall back on blocking mode, since otherwise reads would
+fail with `EAGAIN`.
+*/
+func openPty() (master, slave *os.File, err error) {
+	fd, err := unix.Open(`/dev/ptmx`, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	master = os.NewFile(uintptr(fd), `/dev/ptmx`)
+
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+
+	// Deadlines are supported only for files managed by the poller.
+	if master.SetDeadline(time.Time{}) != nil {
+		err = unix.SetNonblock(fd, false)
+		if err != nil {
+			return
+		}
+	}
+
+	err = unix.IoctlSetInt(fd, unix.TIOCPTYGRANT, 0)
+	if err != nil {
+		return
+	}
+
+	err = unix.IoctlSetInt(fd, unix.TIOCPTYUNLK, 0)
+	if err != nil {
+		return
+	}
+
+	// "golang.org/x/sys/unix" doesn't provide a wrapper for this one.
+	var buf [128]byte
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(unix.TIOCPTYGNAME),
+		uintptr(unsafe.Pointer(&buf[0])),
+	)
+	if errno != 0 {
+		err = errno
+		return
+	}
+
+	path := string(buf[:bytes.IndexByte(buf[:], 0)])
+	slave, err = os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	return
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+The master is non-blocking, which allows the Go runtime to poll it, and allows
+`Pty.Deinit` to interrupt a pending read by closing it.
+*/
+func openPty() (master, slave *os.File, err error) {
+	fd, err := unix.Open(`/dev/ptmx`, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	master = os.NewFile(uintptr(fd), `/dev/ptmx`)
+
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		return
+	}
+
+	num, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		return
+	}
+
+	path := `/dev/pts/` + strconv.FormatUint(uint64(num), 10)
+	slave, err = os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	return
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || linux)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Without a PTY, the subprocess runs as if we weren't in raw mode. See `Pty`.
+func openPty() (_, _ *os.File, err error) { return nil, nil, errors.ErrUnsupported }
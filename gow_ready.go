@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+// Interval of readiness checks. See `Cmd.AwaitReady`.
+const READY_POLL_DELAY = time.Millisecond * 50
+
+/*
+Readiness probes; multi. The subprocess is ready once all probes pass.
+Supported probes:
+
+	tcp:<addr>     address accepts TCP connections; "tcp:" is optional
+	http://<url>   URL responds with 2xx; also "https://"
+	log:<regexp>   a line of stdout or stderr matches the regexp
+*/
+type FlagReady []ReadyProbe
+
+func (self *FlagReady) Parse(src string) error {
+	val, err := parseReadyProbe(src)
+	if err != nil {
+		return err
+	}
+	gg.Append(self, val)
+	return nil
+}
+
+func (self FlagReady) Logs() []*regexp.Regexp {
+	return gg.MapCompact(self, func(val ReadyProbe) *regexp.Regexp { return val.Log })
+}
+
+// One of the probes of `FlagReady`. Exactly one of the fields is set.
+type ReadyProbe struct {
+	Src  string
+	Tcp  string
+	Http string
+	Log  *regexp.Regexp
+}
+
+func (self ReadyProbe) String() string { return self.Src }
+
+func parseReadyProbe(src string) (out ReadyProbe, err error) {
+	out.Src = src
+
+	switch {
+	case strings.HasPrefix(src, `http://`), strings.HasPrefix(src, `https://`):
+		out.Http = src
+
+	case strings.HasPrefix(src, `log:`):
+		out.Log, err = regexp.Compile(strings.TrimPrefix(src, `log:`))
+		if err != nil {
+			err = gg.Wrapf(err, `invalid readiness probe %q`, src)
+		}
+
+	default:
+		addr := strings.TrimPrefix(src, `tcp:`)
+		_, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			err = gg.Wrapf(err, `invalid readiness probe %q; expected "tcp:<host>:<port>", "http://<url>", or "log:<regexp>"`, src)
+		}
+		out.Tcp = addr
+	}
+	return
+}
+
+// Returns true if the probe passed. For log probes, uses the given `ReadyLog`.
+func (self ReadyProbe) Check(logs *ReadyLog) bool {
+	if self.Tcp != `` {
+		conn, err := net.DialTimeout(`tcp`, self.Tcp, READY_POLL_DELAY)
+		if err != nil {
+			return false
+		}
+		gg.Nop1(conn.Close())
+		return true
+	}
+
+	if self.Http != `` {
+		res, err := readyClient.Get(self.Http)
+		if err != nil {
+			return false
+		}
+		gg.Nop1(res.Body.Close())
+		return res.StatusCode >= 200 && res.StatusCode < 300
+	}
+
+	if self.Log != nil {
+		return logs != nil && logs.Has(self.Log)
+	}
+	return true
+}
+
+// Doesn't keep connections, which could delay a graceful shutdown of the server.
+var readyClient = http.Client{
+	Timeout:   time.Second,
+	Transport: &http.Transport{DisableKeepAlives: true},
+}
+
+/*
+Receives a copy of the output of one subprocess, and remembers which of the
+regexps of log probes have matched a line. Lines may be split between writes,
+and stdout and stderr are written concurrently.
+*/
+type ReadyLog struct {
+	Lock    sync.Mutex
+	Regs    []*regexp.Regexp
+	Matched gg.Set[*regexp.Regexp]
+	Buf     []byte
+}
+
+// Returns nil if there are no log probes.
+func NewReadyLog(src FlagReady) *ReadyLog {
+	regs := src.Logs()
+	if gg.IsEmpty(regs) {
+		return nil
+	}
+	return &ReadyLog{Regs: regs}
+}
+
+func (self *ReadyLog) Write(src []byte) (int, error) {
+	defer gg.Lock(&self.Lock).Unlock()
+	if self.Matched.Len() >= len(self.Regs) {
+		return len(src), nil
+	}
+
+	self.Buf = append(self.Buf, src...)
+	for {
+		ind := bytes.IndexByte(self.Buf, '\n')
+		if ind < 0 {
+			break
+		}
+		self.match(self.Buf[:ind])
+		self.Buf = self.Buf[ind+1:]
+	}
+
+	// Don't accumulate output without newlines indefinitely.
+	if len(self.Buf) > READY_LOG_MAX_LINE {
+		self.match(self.Buf)
+		self.Buf = nil
+	}
+	return len(src), nil
+}
+
+// Maximum buffered length of an incomplete line. See `ReadyLog`.
+const READY_LOG_MAX_LINE = 1 << 16
+
+func (self *ReadyLog) match(line []byte) {
+	for _, reg := range self.Regs {
+		if reg.Match(line) {
+			self.Matched.Init().Add(reg)
+		}
+	}
+}
+
+func (self *ReadyLog) Has(reg *regexp.Regexp) bool {
+	defer gg.Lock(&self.Lock).Unlock()
+	return self.Matched.Has(reg)
+}
+
+/*
+Waits until the given subprocess is ready, then calls `Cmd.OnReady`. Without
+`Opt.Ready`, the subprocess is considered ready as soon as it starts. Gives up
+when the subprocess exits or is replaced, or after `Opt.ReadyTimeout`.
+
+With readiness probes, `Opt.Suf` is printed once the subprocess is ready,
+rather than when it exits.
+*/
+func (self *Cmd) AwaitReady(pid int, logs *ReadyLog) {
+	opt := self.Task().Opt
+	log := opt.Logger()
+	start := time.Now()
+	timeout := opt.ReadyTimeout.Duration()
+
+	if gg.IsEmpty(opt.Ready) {
+		defer gg.Lock(&self.Lock).Unlock()
+		if self.Pid.Load() == int64(pid) {
+			self.OnReady(pid, 0)
+		}
+		return
+	}
+
+	for _, probe := range opt.Ready {
+		for !probe.Check(logs) {
+			if self.Pid.Load() != int64(pid) {
+				return
+			}
+			if timeout > 0 && time.Since(start) > timeout {
+				log.Printf(`subprocess not ready after %v: readiness probe %q did not pass`, timeout, probe)
+				return
+			}
+			time.Sleep(READY_POLL_DELAY)
+		}
+	}
+
+	/**
+	Serialized with `Cmd.ClearPid`. Otherwise, a subprocess which exits right
+	after passing the probes could be reported as ready after its failure,
+	which would release held requests of `Proxy` to a server which is gone.
+	*/
+	defer gg.Lock(&self.Lock).Unlock()
+	if self.Pid.Load() != int64(pid) {
+		return
+	}
+
+	dur := time.Since(start)
+	log.Printf(`subprocess ready after %v`, dur)
+	self.ReadyPid.Store(int64(pid))
+	opt.TermSuf()
+	self.OnReady(pid, dur)
+}
+
+/*
+Reports readiness to the event stream, releases requests held by `Proxy`, and
+reloads browsers; see `Reload`. Browsers are reloaded only by tasks with
+readiness probes, since other tasks are considered ready too early.
+*/
+func (self *Cmd) OnReady(pid int, dur time.Duration) {
+	task := self.Task()
+	task.Emit(Event{Type: EventTypeReady, Pid: pid, Duration: dur.Milliseconds()})
+	task.Proxy.Resume()
+
+	main := task.Main()
+	if main != nil && main.Reload.IsActive() && gg.IsNotEmpty(task.Opt.Ready) {
+		if task.IsVerb() {
+			task.Opt.Logger().Println(`reloading browsers`)
+		}
+		main.Reload.Send()
+	}
+}
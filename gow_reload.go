@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Optional live-reload server, enabled via `Opt.Reload`. Browsers subscribe to
+Server-Sent Events, and reload the page once a restarted subprocess is ready;
+see `Cmd.AwaitReady`. The server runs in `gow` rather than in the subprocess,
+so browsers stay connected across restarts. Endpoints:
+
+	GET /events       SSE stream with "reload" events
+	GET /reload.js    script which subscribes to "/events" and reloads the page
+
+The script is meant to be included in development builds of the pages:
+
+	<script src="http://localhost:35729/reload.js"></script>
+*/
+type Reload struct {
+	Mained
+	Lock     sync.Mutex
+	Clients  gg.Set[gg.Chan[struct{}]]
+	Listener net.Listener
+	Server   http.Server
+}
+
+func (self *Reload) Init(main *Main) {
+	self.Mained.Init(main)
+
+	src := main.Opt.Reload
+	if src == `` {
+		return
+	}
+
+	/**
+	Without readiness probes, the subprocess is considered ready as soon as it
+	starts, which is usually before the server listens. Browsers would reload
+	into a connection error.
+	*/
+	if !gg.Some(main.Tasks, func(task *Task) bool { return gg.IsNotEmpty(task.Opt.Ready) }) {
+		panic(gg.Errf(`live reload "--reload" requires a readiness probe "--ready"`))
+	}
+
+	lis, err := listenLoopback(src)
+	if err != nil {
+		panic(gg.Wrapf(err, `unable to start live-reload server on %q`, src))
+	}
+	self.Listener = lis
+	self.Server.Handler = self.Handler()
+
+	if main.IsVerb() {
+		log.Printf(`live-reload server listening on %q`, lis.Addr())
+	}
+}
+
+func (self *Reload) Deinit() {
+	if self.Listener != nil {
+		gg.Nop1(self.Server.Close())
+		self.Listener = nil
+	}
+}
+
+func (self *Reload) IsActive() bool { return self.Listener != nil }
+
+func (self *Reload) Run() {
+	err := self.Server.Serve(self.Listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println(`live-reload server error:`, err)
+	}
+}
+
+func (self *Reload) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`GET /events`, self.OnEvents)
+	mux.HandleFunc(`GET /reload.js`, self.OnScript)
+	return mux
+}
+
+// Tells all connected browsers to reload. Doesn't block.
+func (self *Reload) Send() {
+	defer gg.Lock(&self.Lock).Unlock()
+	for client := range self.Clients {
+		client.SendZeroOpt()
+	}
+}
+
+func (self *Reload) OnEvents(rew http.ResponseWriter, req *http.Request) {
+	flusher, _ := rew.(http.Flusher)
+	if flusher == nil {
+		http.Error(rew, `streaming is not supported`, http.StatusInternalServerError)
+		return
+	}
+
+	var client gg.Chan[struct{}]
+	client.InitCap(1)
+	self.addClient(client)
+	defer self.delClient(client)
+
+	head := rew.Header()
+	head.Set(`Content-Type`, `text/event-stream`)
+	head.Set(`Cache-Control`, `no-cache`)
+	head.Set(`Access-Control-Allow-Origin`, `*`)
+	rew.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-client:
+			_, err := fmt.Fprint(rew, "event: reload\ndata: {}\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (*Reload) OnScript(rew http.ResponseWriter, _ *http.Request) {
+	head := rew.Header()
+	head.Set(`Content-Type`, `text/javascript`)
+	head.Set(`Cache-Control`, `no-cache`)
+	head.Set(`Access-Control-Allow-Origin`, `*`)
+	gg.Nop2(rew.Write([]byte(RELOAD_SCRIPT)))
+}
+
+func (self *Reload) addClient(val gg.Chan[struct{}]) {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Clients.Init().Add(val)
+}
+
+func (self *Reload) delClient(val gg.Chan[struct{}]) {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Clients.Del(val)
+}
+
+/*
+Served by `Reload` at "/reload.js". Resolves "/events" relative to its own URL,
+so it works regardless of which port the page itself is served on.
+*/
+const RELOAD_SCRIPT = `void function() {
+	const url = new URL('/events', document.currentScript.src)
+	const events = new EventSource(url)
+	events.addEventListener('reload', function() {location.reload()})
+}()
+`
+
+// See `loopbackAddr`.
+func listenLoopback(src string) (net.Listener, error) {
+	addr, err := loopbackAddr(src)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(`tcp`, addr)
+}
@@ -39,7 +39,7 @@ handled by this program; see below.
 func (self *Sig) Init(main *Main) {
 	self.Mained.Init(main)
 	self.Chan.InitCap(1)
-	signal.Notify(self.Chan, KILL_SIGS_OS...)
+	signal.Notify(self.Chan, gg.Concat(KILL_SIGS_OS, []os.Signal{syscall.SIGWINCH, syscall.SIGUSR1})...)
 }
 
 func (self *Sig) Run() {
@@ -51,14 +51,27 @@ func (self *Sig) Run() {
 		sig := val.(syscall.Signal)
 
 		if KILL_SIG_SET.Has(sig) {
-			if main.Opt.Verb {
+			if main.IsVerb() {
 				log.Println(`received kill signal:`, sig)
 			}
 			main.Kill(sig)
 			continue
 		}
 
-		if main.Opt.Verb {
+		// The terminal window was resized. See `Pty.Resize`.
+		if sig == syscall.SIGWINCH {
+			main.ResizePty()
+			continue
+		}
+
+		// Allows to pause and resume watching without hotkeys, for example
+		// from scripts. See `Main.SetPaused`.
+		if sig == syscall.SIGUSR1 {
+			main.TogglePause()
+			continue
+		}
+
+		if main.IsVerb() {
 			log.Println(`received unknown signal:`, sig)
 		}
 	}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mitranim/gg"
 )
@@ -16,14 +17,22 @@ const DoubleInputDelay = time.Second
 /*
 Standard input/output adapter for terminal raw mode. Raw mode allows us to
 support our own control codes, but we're also responsible for interpreting
-common ASCII codes into OS signals, and optionally for echoing other characters
-to stdout. This adapter is unnecessary in non-raw mode where we simply pipe
-stdio to/from the child process.
+common ASCII codes into OS signals, for forwarding other characters to the
+subprocess (see `StdinMode`), and optionally for echoing them to stdout. This
+adapter is unnecessary in non-raw mode where we simply pipe stdio to/from the
+child process.
 */
 type Stdio struct {
 	Mained
-	LastChar byte
+	Keys     Hotkeys
+	LastKey  string
 	LastInst time.Time
+	Line     []byte
+}
+
+func (self *Stdio) Init(main *Main) {
+	self.Mained.Init(main)
+	self.Keys = NewHotkeys(main.Opt.Keys)
 }
 
 /*
@@ -39,9 +48,42 @@ TODO: ideally, this should be used only in terminal raw mode. See the comment in
 func (self *Stdio) Run() {
 	self.LastInst = time.Now()
 
+	var dec KeyDecoder
+	chunks := make(gg.Chan[[]byte])
+	go readStdin(chunks)
+
+	for {
+		var timeout <-chan time.Time
+		if dec.IsPending() {
+			timeout = time.After(KEY_ESC_WAIT)
+		}
+
+		select {
+		case src, ok := <-chunks:
+			if !ok {
+				return
+			}
+			self.OnKeys(dec.Decode(src))
+
+		case <-timeout:
+			self.OnKeys(dec.Flush())
+		}
+	}
+}
+
+/*
+Reading happens on a separate goroutine, which allows `Stdio.Run` to wait for
+the rest of an escape sequence with a timeout. See `KeyDecoder`.
+*/
+func readStdin(out gg.Chan[[]byte]) {
+	defer close(out)
+	var buf [256]byte
+
 	for {
-		var buf [1]byte
 		size, err := os.Stdin.Read(buf[:])
+		if size > 0 {
+			out <- gg.Clone(buf[:size])
+		}
 		if errors.Is(err, io.EOF) {
 			return
 		}
@@ -49,99 +91,174 @@ func (self *Stdio) Run() {
 			log.Println(`error when reading stdin, shutting down stdio:`, err)
 			return
 		}
-		gg.Try(err)
 		if size <= 0 {
 			return
 		}
-		self.OnByte(buf[0])
+	}
+}
+
+func (self *Stdio) OnKeys(keys []string) {
+	for _, key := range keys {
+		self.OnKey(key)
 	}
 }
 
 /*
-Interpret known ASCII codes as OS signals.
+Interpret hotkeys bound via `Opt.Keys` as actions.
 Otherwise forward the input to the subprocess.
 */
-func (self *Stdio) OnByte(char byte) {
+func (self *Stdio) OnKey(key string) {
 	defer recLog()
-	defer self.AfterByte(char)
-
-	switch char {
-	case CODE_INTERRUPT:
-		self.OnCodeInterrupt()
+	defer self.AfterKey(key)
 
-	case CODE_QUIT:
-		self.OnCodeQuit()
-
-	case CODE_PRINT_COMMAND:
-		self.OnCodePrintCommand()
-
-	case CODE_RESTART:
-		self.OnCodeRestart()
+	/**
+	Most terminals send the delete code for the backspace key. While the
+	subprocess accepts input, it's used for erasing input. ^H still prints help.
+	*/
+	if key == string(rune(ASCII_DELETE)) && self.Main().HasInput() {
+		self.OnInput(key)
+		return
+	}
 
-	case CODE_STOP:
-		self.OnCodeStop()
+	action := self.Keys.Get(key)
+	if action == nil {
+		self.OnInput(key)
+		return
+	}
 
-	case CODE_PRINT_HELP, CODE_PRINT_HELP_MACOS:
-		self.OnCodePrintHelp()
+	self.EmitHotkey(key, action)
+	action.Fun(self, key)
+}
 
-	default:
-		self.OnByteAny(char)
-	}
+// Reports hotkeys to the event stream, if enabled. See `Events`.
+func (self *Stdio) EmitHotkey(key string, action *Action) {
+	self.Main().Events.Send(Event{Type: EventTypeHotkey, Key: keyName(key), Action: action.Name})
 }
 
-func (self *Stdio) AfterByte(char byte) {
-	self.LastChar = char
+func (self *Stdio) AfterKey(key string) {
+	self.LastKey = key
 	self.LastInst = time.Now()
 }
 
-func (self *Stdio) OnCodeInterrupt() {
-	self.OnCodeSig(CODE_INTERRUPT, syscall.SIGINT, `^C`)
+func (self *Stdio) OnCodeInterrupt(key string) {
+	self.OnCodeSig(key, syscall.SIGINT)
 }
 
-func (self *Stdio) OnCodeQuit() {
-	self.OnCodeSig(CODE_QUIT, syscall.SIGQUIT, `^\`)
+func (self *Stdio) OnCodeQuit(key string) {
+	self.OnCodeSig(key, syscall.SIGQUIT)
 }
 
 // TODO include all current subproces with their args.
-func (*Stdio) OnCodePrintCommand() {
+func (self *Stdio) OnCodePrintCommand(string) {
 	log.Printf(`current command: %q`, os.Args)
+
+	main := self.Main()
+	if main.IsMultiTask() {
+		for _, task := range main.Tasks {
+			log.Printf(`task %q: %q`, task.Name, gg.Concat([]string{task.Opt.Cmd}, task.Opt.Args))
+		}
+	}
 }
 
-func (*Stdio) OnCodePrintHelp() { log.Println(HOTKEY_HELP) }
+func (self *Stdio) OnCodePrintHelp(string) { log.Println(self.Keys.Help()) }
 
-func (self *Stdio) OnCodeRestart() {
+func (self *Stdio) OnCodeRestart(key string) {
 	main := self.Main()
-	if main.Opt.Verb {
-		log.Println(`received ^R, restarting`)
+	if main.IsVerb() {
+		log.Println(`received ` + keyName(key) + `, restarting`)
 	}
 	main.Restart()
 }
 
-func (self *Stdio) OnCodeStop() {
-	self.OnCodeSig(CODE_STOP, syscall.SIGTERM, `^T`)
+func (self *Stdio) OnCodeStop(key string) {
+	self.OnCodeSig(key, syscall.SIGTERM)
+}
+
+// Clears the terminal, hard or soft according to `Opt.ClearHard`.
+func (self *Stdio) OnCodeClear(string) {
+	if self.Main().Opt.ClearHard {
+		gg.Write(os.Stdout, TermEscClearHard)
+	} else {
+		gg.Write(os.Stdout, TermEscClearSoft)
+	}
+}
+
+func (self *Stdio) OnCodeToggleVerbose(string) { self.Main().ToggleVerbose() }
+
+func (self *Stdio) OnCodeTogglePause(string) { self.Main().TogglePause() }
+
+/*
+Forwards input to the subprocess according to `StdinMode`. With a PTY, the PTY
+echoes input according to the settings of the subprocess; see `Pty`. Otherwise
+we echo it ourselves, depending on `EchoMode`.
+*/
+func (self *Stdio) OnInput(key string) {
+	main := self.Main()
+	if main.HasPty() {
+		main.SendInput([]byte(key))
+		return
+	}
+	if main.Opt.Stdin == StdinModeLine {
+		self.OnInputLine(key)
+		return
+	}
+	self.Echo(key)
+	main.SendInput([]byte(key))
 }
 
-func (self *Stdio) OnByteAny(char byte) {
-	if self.Main().GetEchoMode() == EchoModeGow {
-		gg.Nop2(writeByte(os.Stdout, char))
+/*
+In "line" mode, input is buffered until a newline, and the delete code erases
+the last character. Escape sequences such as arrow keys are ignored. Lines
+typed while no subprocess is running are dropped.
+*/
+func (self *Stdio) OnInputLine(key string) {
+	if key == string(rune(ASCII_DELETE)) {
+		if len(self.Line) > 0 {
+			_, size := utf8.DecodeLastRune(self.Line)
+			self.Line = self.Line[:len(self.Line)-size]
+			self.Echo("\b \b")
+		}
+		return
+	}
+
+	if key[0] == ASCII_ESCAPE {
+		return
+	}
+
+	self.Echo(key)
+	self.Line = append(self.Line, key...)
+	if key == NEWLINE {
+		self.Main().SendInput(self.Line)
+		self.Line = nil
+	}
+}
+
+/*
+Escape sequences are not echoed, since the terminal would interpret them, for
+example moving the cursor on arrow keys.
+*/
+func (self *Stdio) Echo(key string) {
+	if self.Main().GetEchoMode() == EchoModeGow && key[0] != ASCII_ESCAPE {
+		gg.Nop2(io.WriteString(os.Stdout, key))
 	}
 }
 
-func (self *Stdio) OnCodeSig(code byte, sig syscall.Signal, desc string) {
+func (self *Stdio) OnCodeSig(key string, sig syscall.Signal) {
 	main := self.Main()
+	desc := keyName(key)
 
-	if self.IsCodeRepeated(code) {
+	if self.IsKeyRepeated(key) {
 		log.Println(`received ` + desc + desc + `, shutting down`)
 		main.Kill(sig)
 		return
 	}
 
-	if main.Opt.Verb {
+	if main.IsVerb() {
 		log.Println(`broadcasting ` + desc + ` to subprocesses; repeat within ` + DoubleInputDelay.String() + ` to kill gow`)
 	}
-	main.Cmd.Broadcast(sig)
+	main.Interrupt(sig)
 }
 
-func (self *Stdio) IsCodeRepeated(char byte) bool {
-	return self.LastChar == char && time.Since(self.LastInst) < DoubleInputDelay
+func (self *Stdio) IsKeyRepeated(key string) bool {
+	return self.LastKey == key && time.Since(self.LastInst) < DoubleInputDelay
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	l "log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+One watched command with its own options and subprocess. Usually there's only
+one task, with an empty name, configured by the CLI. When multiple "@profile"
+arguments are given, each profile from the config file becomes a separate
+named task, and all tasks run concurrently in one `gow` process. They share the
+watcher, the terminal, and the stdin reader, which is what allows to use raw
+mode and hotkeys with multiple commands; see `Term.Init`.
+
+Output of named tasks, including our own logging, is prefixed with the task
+name.
+*/
+type Task struct {
+	Mained
+	Name        string
+	Opt         Opt
+	Cmd         Cmd
+	Debounce    Debounce
+	Deps        Deps
+	Pending     Pending
+	Paused      Pending
+	Status      TaskStatus
+	Proxy       Proxy
+	Stdout      io.Writer
+	Stderr      io.Writer
+	ChanRestart gg.Chan[struct{}]
+	ChanStop    gg.Chan[syscall.Signal]
+	Done        gg.Chan[struct{}]
+	Verb        atomic.Bool
+}
+
+func (self *Task) Init(main *Main, name string, opt Opt) {
+	self.Mained.Init(main)
+	self.Name = name
+	self.Opt = opt
+	self.Verb.Store(opt.Verb)
+	self.Stdout = os.Stdout
+	self.Stderr = os.Stderr
+
+	if name != `` {
+		self.Opt.Log = l.New(os.Stderr, `[gow] [`+name+`] `, 0)
+		self.Stdout = NewLineWriter(os.Stdout, `[`+name+`] `)
+		self.Stderr = NewLineWriter(os.Stderr, `[`+name+`] `)
+	}
+
+	self.ChanRestart.Init()
+	self.ChanStop.Init()
+	self.Done.Init()
+	self.Cmd.Init(self)
+	if self.Opt.Build {
+		self.Cmd.BuildInit()
+	}
+	self.Proxy.Init(self)
+	self.Debounce.Init(self)
+	self.Deps.Init(self)
+}
+
+func (self *Task) Deinit() {
+	self.Debounce.Deinit()
+	self.Deps.Deinit()
+	self.Cmd.Deinit()
+	self.Cmd.BuildDeinit()
+	self.Proxy.Deinit()
+}
+
+/*
+Verbose logging, initially `Opt.Verb`. Atomic because it may be toggled via
+hotkeys while other goroutines are logging; see `Main.ToggleVerbose`.
+*/
+func (self *Task) IsVerb() bool { return self.Verb.Load() }
+
+func (self *Task) LogCmdExit(err error, dur time.Duration) {
+	log := self.Opt.Logger()
+	if err == nil {
+		if self.IsVerb() {
+			log.Printf(`subprocess done in %v`, dur)
+		}
+		return
+	}
+
+	if self.IsVerb() || !self.Opt.ShouldSkipErr(err) {
+		log.Printf(`subprocess error after %v: %v`, dur, err)
+	}
+}
+
+func (self *Task) Run() {
+	defer close(self.Done)
+
+	if self.Debounce.IsActive() {
+		go self.Debounce.Run()
+	}
+	if self.Deps.IsActive() {
+		go self.Deps.Run()
+	}
+	if self.Proxy.IsActive() {
+		go self.Proxy.Run()
+	}
+
+	if !self.Opt.Postpone {
+		self.Cmd.Restart()
+	}
+
+	// Non-nil while an automatic restart is delayed by crash-loop backoff.
+	var delayed <-chan time.Time
+
+	for {
+		select {
+		case <-self.ChanRestart:
+			if !self.Pending.IsManual() {
+				if delayed != nil {
+					continue
+				}
+				delay := self.RestartDelay()
+				if delay > 0 {
+					delayed = time.After(delay)
+					continue
+				}
+			}
+			delayed = nil
+			self.Opt.TermInter()
+			self.Cmd.Restart()
+
+		case <-delayed:
+			delayed = nil
+			self.Opt.TermInter()
+			self.Cmd.Restart()
+
+		case sig := <-self.ChanStop:
+			self.Cmd.Stop(sig)
+			return
+		}
+	}
+}
+
+/*
+Stops the subprocess and the `Task.Run` loop, waiting for both. Must be called
+only after starting `Task.Run`.
+*/
+func (self *Task) Stop(sig syscall.Signal) {
+	self.ChanStop.Send(sig)
+	<-self.Done
+}
+
+/*
+Delay of the next automatic restart, when the subprocess seems to be in a crash
+loop. See `Backoff`.
+*/
+func (self *Task) RestartDelay() time.Duration {
+	delay := self.Cmd.Backoff.Delay(self.Opt, time.Now())
+	if delay > 0 {
+		self.Opt.Logger().Printf(
+			`subprocess failed at least %v times within %v, delaying restart by %v`,
+			self.Opt.BackoffFails, self.Opt.BackoffWindow, delay,
+		)
+	}
+	return delay
+}
+
+func (self *Task) OnFsEvent(event FsEvent) {
+	if event != nil {
+		self.Opt.IgnoreFiles.OnPath(event.Path())
+		self.Deps.OnPath(event.Path())
+	}
+	if !self.ShouldRestart(event) {
+		return
+	}
+	self.Emit(Event{Type: EventTypeFsEvent, Path: event.Path(), Op: fsEventOp(event)})
+	if self.Debounce.IsActive() {
+		self.Debounce.Events.Send(event)
+		return
+	}
+	if self.IsVerb() {
+		self.Opt.Logger().Println(`restarting on FS event:`, event)
+	}
+	self.RestartOnPaths(event.Path())
+}
+
+// Called by `Debounce` once a burst of FS events settles.
+func (self *Task) OnFsEvents(paths []string) {
+	if gg.IsEmpty(paths) {
+		return
+	}
+	if self.IsVerb() {
+		self.Opt.Logger().Printf(`restarting on FS events, changed paths: %q`, paths)
+	}
+	self.RestartOnPaths(paths...)
+}
+
+/*
+While watching is paused, events which would otherwise cause a restart are
+recorded in `Task.Paused` instead. See `Task.Resume`.
+*/
+func (self *Task) ShouldRestart(event FsEvent) bool {
+	if event == nil || !self.Allows(event.Path()) {
+		return false
+	}
+	if self.IsPaused() {
+		self.Paused.AddPaths(event.Path())
+		return false
+	}
+	return !(self.Opt.Lazy && self.Cmd.IsRunning())
+}
+
+func (self *Task) Allows(path string) bool {
+	return self.Watches(path) &&
+		self.Opt.AllowPath(path) &&
+		self.Deps.Allow(path)
+}
+
+// See `Main.SetPaused`.
+func (self *Task) IsPaused() bool {
+	main := self.Main()
+	return main != nil && main.Paused.Load()
+}
+
+/*
+Called by `Main.SetPaused` when watching is resumed. Changes recorded while
+paused cause at most one restart, and only with `Opt.ResumeRestart`.
+*/
+func (self *Task) Resume() {
+	paths, _ := self.Paused.Take()
+	if gg.IsEmpty(paths) {
+		return
+	}
+
+	log := self.Opt.Logger()
+	if !self.Opt.ResumeRestart {
+		log.Println(`files changed while paused, not restarting; see "--resume-restart"`)
+		return
+	}
+	if self.Opt.Lazy && self.Cmd.IsRunning() {
+		log.Println(`files changed while paused, not restarting in lazy mode`)
+		return
+	}
+
+	if self.IsVerb() {
+		log.Printf(`restarting on changes made while paused, changed paths: %q`, paths)
+	} else {
+		log.Println(`files changed while paused, restarting`)
+	}
+	self.RestartOnPaths(paths...)
+}
+
+/*
+The watcher watches the directories of all tasks. Each task should react only
+to changes in its own directories.
+*/
+func (self *Task) Watches(path string) bool {
+	main := self.Main()
+	if main == nil {
+		return true
+	}
+
+	dirs := self.WatchDirs()
+	if gg.Equal(dirs, main.WatchDirs()) {
+		return true
+	}
+	return gg.Some(dirs, func(dir string) bool {
+		return isPathInside(path, toAbsPath(dir))
+	})
+}
+
+// `Opt.WatchDirs` and the local modules outside of them; see `Deps.Outer`.
+func (self *Task) WatchDirs() []string {
+	return gg.Concat(self.Opt.WatchDirs, self.Deps.OuterDirs())
+}
+
+/*
+Sends an event to the event stream, if enabled; see `Events`. Events of named
+tasks include the task name. Also records the status reported by `Api`.
+*/
+func (self *Task) Emit(val Event) {
+	val.Time = time.Now()
+	val.Task = self.Name
+	self.Status.OnEvent(val)
+
+	main := self.Main()
+	if main != nil {
+		main.Events.Send(val)
+	}
+}
+
+// Manual restart, which always runs the full command.
+func (self *Task) Restart() {
+	self.Pending.SetManual()
+	self.ChanRestart.SendZeroOpt()
+}
+
+/*
+Automatic restart without FS changes, used by `Opt.RestartMode`. Always runs
+the full command.
+*/
+func (self *Task) RestartAuto() { self.ChanRestart.SendZeroOpt() }
+
+// Automatic restart caused by changes in the given paths.
+func (self *Task) RestartOnPaths(paths ...string) {
+	self.Pending.AddPaths(paths...)
+	self.ChanRestart.SendZeroOpt()
+}
+
+/*
+Making `.task` private reduces the chance of accidental cyclic walking by
+reflection tools such as pretty printers.
+*/
+type Tasked struct{ task *Task }
+
+func (self *Tasked) Init(val *Task) { self.task = val }
+func (self *Tasked) Task() *Task    { return self.task }
+
+/*
+Prefixes each line with the given prefix. Buffers incomplete lines, which
+prevents output of concurrent tasks from being mixed within one line. Must be
+flushed via `LineWriter.Flush` after the writes are done.
+*/
+type LineWriter struct {
+	Lock   sync.Mutex
+	Out    io.Writer
+	Prefix []byte
+	Buf    []byte
+}
+
+func NewLineWriter(out io.Writer, prefix string) *LineWriter {
+	return &LineWriter{Out: out, Prefix: []byte(prefix)}
+}
+
+func (self *LineWriter) Write(src []byte) (int, error) {
+	defer gg.Lock(&self.Lock).Unlock()
+
+	self.Buf = append(self.Buf, src...)
+	ind := bytes.LastIndexByte(self.Buf, '\n')
+	if ind < 0 {
+		return len(src), nil
+	}
+
+	out := self.prefixLines(self.Buf[:ind+1])
+	self.Buf = append(self.Buf[:0], self.Buf[ind+1:]...)
+	_, err := self.Out.Write(out)
+	return len(src), err
+}
+
+// Writes the incomplete last line, if any.
+func (self *LineWriter) Flush() {
+	defer gg.Lock(&self.Lock).Unlock()
+	if len(self.Buf) > 0 {
+		out := self.prefixLines(append(self.Buf, '\n'))
+		self.Buf = self.Buf[:0]
+		gg.Nop2(self.Out.Write(out))
+	}
+}
+
+// Input must end with a newline.
+func (self *LineWriter) prefixLines(src []byte) []byte {
+	var out []byte
+	for len(src) > 0 {
+		ind := bytes.IndexByte(src, '\n')
+		out = append(out, self.Prefix...)
+		out = append(out, src[:ind+1]...)
+		src = src[ind+1:]
+	}
+	return out
+}
+
+// Used by `Cmd` after the subprocess exits.
+func flushWriter(val io.Writer) {
+	impl, _ := val.(interface{ Flush() })
+	if impl != nil {
+		impl.Flush()
+	}
+}
@@ -79,8 +79,8 @@ Goal:
 
 Known issue: race condition between multiple concurrent `gow` processes in the
 same terminal tab. This is common when running `gow` recipes in a makefile.
-Our own `makefile` provides an example of how to avoid using multiple raw modes
-concurrently.
+Multiple commands can instead run as tasks in one `gow` process, which owns the
+terminal state; see `Task`. Our own `makefile` provides examples of both.
 */
 func (self *Term) Init(main *Main) {
 	self.Deinit()
@@ -123,7 +123,7 @@ func (self *Term) Init(main *Main) {
 
 	case EchoModeGow:
 		// We suppress the default echoing here and replicate it ourselves in
-		// `Stdio.OnByteAny`.
+		// `Stdio.Echo`.
 		next.Lflag &^= unix.ECHO
 
 	case EchoModePreserve:
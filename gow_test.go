@@ -1,22 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	l "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/mitranim/gg"
 	"github.com/mitranim/gg/gtest"
+	"github.com/rjeczalik/notify"
 )
 
-var testIgnoredPath = filepath.Join(cwd, `ignore3/file.ext3`)
+func testIgnoredPath() string { return filepath.Join(cwd, `ignore3/file.ext3`) }
 
-var testIgnoredEvent = FsEvent(TestFsEvent(testIgnoredPath))
+func testIgnoredEvent() FsEvent { return TestFsEvent(testIgnoredPath()) }
 
-var testOpt = func() (tar Opt) {
+func testOpt() (tar Opt) {
 	tar.Init([]string{
 		`-e=ext1`,
 		`-e=ext2`,
@@ -27,9 +43,18 @@ var testOpt = func() (tar Opt) {
 		`some_command`,
 	})
 	return
-}()
+}
 
-var testMain = Main{Opt: testOpt}
+// Env vars and config dir for `Opt.Env`, independent from the real ones.
+func testOptEnv(env map[string]string, dir string) OptEnv {
+	return OptEnv{
+		Lookup: func(key string) (string, bool) {
+			val, ok := env[key]
+			return val, ok
+		},
+		Dir: dir,
+	}
+}
 
 type TestFsEvent string
 
@@ -39,12 +64,12 @@ func TestFlagExtensions(t *testing.T) {
 	defer gtest.Catch(t)
 
 	opt := OptDefault()
-	gtest.Equal(opt.Extensions, FlagExtensions{`go`, `mod`})
+	gtest.Equal(opt.Extensions.Vals, []string{`go`, `mod`})
 
 	{
 		var tar FlagExtensions
 		gtest.NoErr(tar.Parse(`one,two,three`))
-		gtest.Equal(tar, FlagExtensions{`one`, `two`, `three`})
+		gtest.Equal(tar.Vals, []string{`one`, `two`, `three`})
 	}
 
 	{
@@ -52,8 +77,699 @@ func TestFlagExtensions(t *testing.T) {
 		gtest.NoErr(tar.Parse(`one`))
 		gtest.NoErr(tar.Parse(`two`))
 		gtest.NoErr(tar.Parse(`three`))
-		gtest.Equal(tar, FlagExtensions{`one`, `two`, `three`})
+		gtest.Equal(tar.Vals, []string{`one`, `two`, `three`})
+	}
+}
+
+func TestOpt_PathRules(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var opt Opt
+	opt.Init([]string{`--exclude`, `one.go`, `-e=html`, `--include=two.sql`, `-v`, `--exclude=three.go`, `some_command`})
+
+	gtest.Equal(opt.PathRules, []PathRule{
+		{Glob: `one.go`, Exclude: true},
+		{Glob: `**/*.html`},
+		{Glob: `two.sql`},
+		{Glob: `three.go`, Exclude: true},
+	})
+
+	// Flags refer to the rules only while parsing.
+	gtest.Zero(opt.Extensions.Rules)
+	gtest.Zero(opt.Include.Rules)
+	gtest.Zero(opt.Exclude.Rules)
+
+	// Defaults go first.
+	opt = Opt{}
+	opt.Init([]string{`--exclude=one.go`, `some_command`})
+	gtest.Equal(opt.PathRules, []PathRule{
+		{Glob: `**/*.go`},
+		{Glob: `**/*.mod`},
+		{Glob: `one.go`, Exclude: true},
+	})
+}
+
+func TestDebounce_Collect(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var task Task
+	task.Opt.Debounce = FlagDuration(time.Millisecond * 10)
+	task.Opt.DebounceMax = FlagDuration(time.Second)
+
+	// Buffered, which allows to send the whole burst before collecting, without
+	// depending on timing. `Debounce.Init` keeps the existing channel.
+	task.Debounce.Events.InitCap(3)
+	task.Debounce.Init(&task)
+
+	task.Debounce.Events.Send(TestFsEvent(`one`))
+	task.Debounce.Events.Send(TestFsEvent(`two`))
+	task.Debounce.Events.Send(TestFsEvent(`one`))
+
+	gtest.Equal(task.Debounce.Collect(), []string{`one`, `two`})
+	gtest.Zero(len(task.Debounce.Events))
+}
+
+func TestWatchPoll(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	write := func(path, body string) {
+		path = filepath.Join(dir, path)
+		gg.Try(os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		gg.Try(os.WriteFile(path, []byte(body), os.ModePerm))
+	}
+
+	write(`one.go`, `one`)
+	write(`two.txt`, `two`)
+	write(`ignored/three.go`, `three`)
+
+	src := []string{`-wm=poll`, `-i=` + filepath.Join(dir, `ignored`), `some_command`}
+	var main Main
+	main.Opt.Init(src)
+	main.TasksInit(src)
+
+	var wat WatchPoll
+	wat.Dirs = []string{dir}
+	wat.Init(&main)
+	gtest.Equal(gg.MapKeys(wat.State), []string{filepath.Join(dir, `one.go`)})
+
+	write(`one.go`, `one_changed`)
+	write(`four.go`, `four`)
+	write(`ignored/three.go`, `three_changed`)
+
+	events := pollDiff(wat.State, wat.Walk())
+	sort.Slice(events, func(one, two int) bool { return events[one].File < events[two].File })
+
+	gtest.Equal(events, []PollEvent{
+		{`create`, filepath.Join(dir, `four.go`)},
+		{`write`, filepath.Join(dir, `one.go`)},
+	})
+}
+
+func TestWatchNotify_fallback(t *testing.T) {
+	defer gtest.Catch(t)
+
+	one := t.TempDir()
+	two := t.TempDir()
+	src := []string{`-w=` + one, `-w=` + two, `some_command`}
+	var main Main
+	main.Opt.Init(src)
+	main.TasksInit(src)
+
+	// Simulates a recursive watch which fails midway, leaving some watches.
+	defer gg.SnapSwap(&notifyWatch, func(path string, out chan<- notify.EventInfo, events ...notify.Event) error {
+		err := notify.Watch(path, out, events...)
+		if err == nil && strings.HasPrefix(path, two) {
+			err = os.NewSyscallError(`inotify_add_watch`, syscall.ENOSPC)
+		}
+		return err
+	}).Done()
+
+	var buf gg.Buf
+	defer gg.SnapSwap(&log, l.New(&buf, ``, 0)).Done()
+
+	var wat WatchNotify
+	wat.Init(&main)
+	defer wat.Deinit()
+	gtest.NotZero(wat.Poll)
+	gtest.Equal(wat.Poll.Dirs, []string{two})
+	gtest.TextHas(buf.String(), `unable to watch `+strconv.Quote(two))
+	gtest.TextHas(buf.String(), `falling back on polling its entire tree`)
+
+	receive := func() string {
+		select {
+		case event := <-wat.Events:
+			return event.Path()
+		case <-time.After(time.Millisecond * 100):
+			return ``
+		}
+	}
+
+	// Changes in the polled directory are not reported by native FS events.
+	gg.Try(os.WriteFile(filepath.Join(two, `file.go`), nil, os.ModePerm))
+	gtest.Zero(receive())
+
+	gg.Try(os.WriteFile(filepath.Join(one, `file.go`), nil, os.ModePerm))
+	gtest.Eq(receive(), filepath.Join(one, `file.go`))
+}
+
+func TestWatchNotify_Sync(t *testing.T) {
+	defer gtest.Catch(t)
+
+	one := t.TempDir()
+	two := t.TempDir()
+	src := []string{`-w=` + one, `some_command`}
+	var main Main
+	main.Opt.Init(src)
+	main.TasksInit(src)
+
+	var wat WatchNotify
+	wat.Init(&main)
+	defer wat.Deinit()
+	gtest.Equal(wat.Dirs, []string{one})
+
+	receive := func() string {
+		select {
+		case event := <-wat.Events:
+			return event.Path()
+		case <-time.After(time.Millisecond * 100):
+			return ``
+		}
+	}
+
+	gg.Try(os.WriteFile(filepath.Join(two, `file.go`), nil, os.ModePerm))
+	gtest.Zero(receive())
+
+	// Simulates `Deps` finding a local module outside of the watched directories.
+	main.Tasks[0].Deps.Outer = []string{two}
+	wat.Sync()
+	gtest.Equal(wat.Dirs, []string{one, two})
+	gtest.True(main.Tasks[0].Watches(filepath.Join(two, `file.go`)))
+
+	gg.Try(os.WriteFile(filepath.Join(two, `file.go`), []byte(`two`), os.ModePerm))
+	gtest.Eq(receive(), filepath.Join(two, `file.go`))
+
+	gg.Try(os.WriteFile(filepath.Join(one, `file.go`), nil, os.ModePerm))
+	gtest.Eq(receive(), filepath.Join(one, `file.go`))
+
+	main.Tasks[0].Deps.Outer = nil
+	wat.Sync()
+	gtest.Equal(wat.Dirs, []string{one})
+}
+
+func Test_isWatchLimitErr(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.True(isWatchLimitErr(syscall.ENOSPC))
+	gtest.True(isWatchLimitErr(os.NewSyscallError(`inotify_add_watch`, syscall.ENOSPC)))
+	gtest.True(isWatchLimitErr(syscall.EMFILE))
+	gtest.False(isWatchLimitErr(syscall.ENOENT))
+
+	gtest.Eq(watchLimitSysctl(syscall.ENOSPC), `fs.inotify.max_user_watches`)
+	gtest.Eq(watchLimitSysctl(syscall.EMFILE), `fs.inotify.max_user_instances`)
+}
+
+func TestOpt_AllowFile(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(opt Opt, path string, exp bool) {
+		msg := fmt.Sprintf(`path: %q`, path)
+		gtest.Eq(opt.AllowFile(filepath.Join(cwd, path)), exp, msg)
+	}
+
+	{
+		var opt Opt
+		opt.Init([]string{
+			`-e=go`,
+			`--exclude=**/*_gen.go`,
+			`--include=keep/*_gen.go`,
+			`--include=./db/**/*.sql`,
+			`--include=go.work`,
+			`--exclude=db/tmp/**`,
+			`some_command`,
+		})
+
+		test(opt, `one.go`, true)
+		test(opt, `one/two.go`, true)
+		test(opt, `one_gen.go`, false)
+		test(opt, `one/two_gen.go`, false)
+		test(opt, `keep/two_gen.go`, true)
+		test(opt, `db/one.sql`, true)
+		test(opt, `db/one/two.sql`, true)
+		test(opt, `db/tmp/two.sql`, false)
+		test(opt, `one.sql`, false)
+		test(opt, `go.work`, true)
+		test(opt, `one/go.work`, false)
+		test(opt, `go.mod`, false)
+	}
+
+	{
+		var opt Opt
+		opt.Init([]string{`-e=`, `--include=Dockerfile`, `some_command`})
+		test(opt, `Dockerfile`, true)
+		test(opt, `one.go`, false)
+	}
+
+	{
+		var opt Opt
+		opt.Init([]string{`-e=`, `--exclude=*.tmp`, `some_command`})
+		test(opt, `one.go`, true)
+		test(opt, `one.tmp`, false)
+	}
+
+	// Default extensions go first, and may be overridden.
+	{
+		var opt Opt
+		opt.Init([]string{`--exclude=**/*_gen.go`, `some_command`})
+		test(opt, `one.go`, true)
+		test(opt, `go.mod`, true)
+		test(opt, `one_gen.go`, false)
+		test(opt, `one.sql`, false)
+	}
+
+	// Explicit extensions are evaluated in their position.
+	{
+		var opt Opt
+		opt.Init([]string{`--exclude`, `**/*_gen.go`, `-e`, `go`, `-v`, `--exclude=two.go`, `some_command`})
+		test(opt, `one.go`, true)
+		test(opt, `one_gen.go`, true)
+		test(opt, `two.go`, false)
+		test(opt, `go.mod`, false)
+		gtest.True(opt.Verb)
+	}
+}
+
+func Test_globMatch(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.True(globMatch(`*.go`, `one.go`))
+	gtest.False(globMatch(`*.go`, `one/two.go`))
+	gtest.True(globMatch(`**/*.go`, `one.go`))
+	gtest.True(globMatch(`**/*.go`, `one/two/three.go`))
+	gtest.True(globMatch(`one/**/*.sql`, `one/two.sql`))
+	gtest.True(globMatch(`one/**/*.sql`, `one/two/three.sql`))
+	gtest.False(globMatch(`one/**/*.sql`, `two/three.sql`))
+	gtest.True(globMatch(`one/**`, `one/two/three`))
+	gtest.False(globMatch(`one/**`, `two/three`))
+	gtest.True(globMatch(`**/one/**`, `two/one/three`))
+	gtest.True(globMatch(`Dockerfile`, `Dockerfile`))
+	gtest.False(globMatch(`Dockerfile`, `one/Dockerfile`))
+	gtest.False(globMatch(`[`, `[`))
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	write := func(path, body string) {
+		path = filepath.Join(dir, path)
+		gg.Try(os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		gg.Try(os.WriteFile(path, []byte(body), os.ModePerm))
+	}
+
+	write(`.gitignore`, "# comment\nnode_modules/\n*_gen.go\n!keep_gen.go\n/tmp\n")
+	write(`sub/.gitignore`, "!*_gen.go\nlocal.go\n")
+	write(`.gowignore`, "dist/**\n")
+
+	// Opt-in.
+	gtest.False(OptDefault().GitIgnore)
+	gtest.True(gg.FlagParseTo[Opt]([]string{`-ig`}).GitIgnore)
+
+	var tar IgnoreFiles
+	tar.Init(true)
+	tar.Root = dir
+
+	test := func(path string, isDir, exp bool) {
+		msg := fmt.Sprintf(`path: %q`, path)
+		gtest.Eq(tar.Ignore(filepath.Join(dir, path), isDir), exp, msg)
+	}
+
+	test(`one.go`, false, false)
+	test(`node_modules`, true, true)
+	test(`node_modules`, false, false)
+	test(`node_modules/one.go`, false, true)
+	test(`one/node_modules/two.go`, false, true)
+	test(`one_gen.go`, false, true)
+	test(`one/two_gen.go`, false, true)
+	test(`keep_gen.go`, false, false)
+	test(`tmp/one.go`, false, true)
+	test(`one/tmp/two.go`, false, false)
+	test(`sub/one_gen.go`, false, false)
+	test(`sub/local.go`, false, true)
+	test(`local.go`, false, false)
+	test(`dist/one/two.go`, false, true)
+
+	tar.Git = false
+	tar.Cache = map[string][]IgnoreRule{}
+	test(`one_gen.go`, false, false)
+	test(`dist/one/two.go`, false, true)
+
+	write(`.gowignore`, "")
+	tar.OnPath(filepath.Join(dir, `.gowignore`))
+	test(`dist/one/two.go`, false, false)
+}
+
+func TestParseGoArgs(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.Equal(
+		ParseGoArgs([]string{`run`, `-tags`, `one`, `-race`, `.`, `-v`, `arg`}),
+		GoArgs{
+			Sub:   `run`,
+			Flags: []string{`-tags`, `one`, `-race`},
+			Pkgs:  []string{`.`},
+			Rest:  []string{`-v`, `arg`},
+		},
+	)
+
+	gtest.Equal(
+		ParseGoArgs([]string{`run`, `one.go`, `two.go`, `arg.go`}).Pkgs,
+		[]string{`one.go`, `two.go`, `arg.go`},
+	)
+
+	args := ParseGoArgs([]string{`test`, `./...`, `-v`, `-count=1`, `-run`, `Test`, `-mod=mod`, `./other`, `-args`, `-one`})
+
+	gtest.Equal(args, GoArgs{
+		Sub:   `test`,
+		Flags: []string{`-v`, `-count=1`, `-run`, `Test`, `-mod=mod`},
+		Pkgs:  []string{`./...`, `./other`},
+		Rest:  []string{`-args`, `-one`},
+	})
+
+	gtest.Equal(args.ListFlags(), []string{`-mod=mod`})
+	gtest.Equal(ParseGoArgs([]string{`vet`, `--tags`, `one`}).ListFlags(), []string{`--tags`, `one`})
+	gtest.Equal(ParseGoArgs([]string{`vet`}).PkgsOrDefault(), []string{`.`})
+}
+
+func TestDeps(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var task Task
+	task.Opt.Init([]string{`-wd`, `vet`})
+	task.Deps.Init(&task)
+
+	gtest.True(task.Deps.Dirs.Has(cwd))
+	gtest.True(task.Deps.Allow(filepath.Join(cwd, `gow_main.go`)))
+	gtest.True(task.Deps.Allow(filepath.Join(cwd, `other/go.mod`)))
+	gtest.True(task.Deps.Allow(filepath.Join(cwd, `other/file.html`)))
+	gtest.False(task.Deps.Allow(filepath.Join(cwd, `other/file.go`)))
+	gtest.Empty(task.Deps.OuterModDirs([]string{`.`}))
+}
+
+func TestGoList_tool(t *testing.T) {
+	defer gtest.Catch(t)
+
+	_, err := GoList(`gow_missing_tool`, `.`)
+	gtest.ErrStr(`unable to run "gow_missing_tool list`, err)
+
+	var buf gg.Buf
+	opt := testOpt()
+	opt.Log = l.New(&buf, ``, 0)
+	opt.Cmd = `gow_missing_tool`
+	opt.Args = []string{`test`, `./...`}
+	_, ok := AffectedTestArgs(opt, []string{filepath.Join(cwd, `gow_main.go`)})
+	gtest.False(ok)
+	gtest.TextHas(buf.String(), `unable to run "gow_missing_tool list`)
+}
+
+func Test_affectedPkgs(t *testing.T) {
+	defer gtest.Catch(t)
+
+	pkgs := []GoPkg{
+		{Dir: `/mod`, ImportPath: `mod`, Imports: []string{`mod/one`, `fmt`}},
+		{Dir: `/mod/one`, ImportPath: `mod/one`, Imports: []string{`mod/two`}},
+		{Dir: `/mod/two`, ImportPath: `mod/two`},
+		{Dir: `/mod/three`, ImportPath: `mod/three`, XTestImports: []string{`mod/two`}},
+		{Dir: `/mod/four`, ImportPath: `mod/four`},
+	}
+
+	test := func(paths []string, exp []string, expOk bool) {
+		out, ok := affectedPkgs(pkgs, paths)
+		gtest.Eq(ok, expOk)
+		gtest.Equal(out, exp)
+	}
+
+	test([]string{`/mod/four/file.go`}, []string{`mod/four`}, true)
+	test([]string{`/mod/one/file.go`}, []string{`mod`, `mod/one`}, true)
+	test([]string{`/mod/two/file.go`}, []string{`mod`, `mod/one`, `mod/three`, `mod/two`}, true)
+	test([]string{`/mod/four/testdata/file.json`}, []string{`mod/four`}, true)
+	test([]string{`/mod/four/file.go`, `/mod/one/file.go`}, []string{`mod`, `mod/four`, `mod/one`}, true)
+	test([]string{`/mod/go.mod`}, nil, false)
+	test([]string{`/other/file.go`}, nil, false)
+}
+
+func Test_parseSignal(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(src string, exp syscall.Signal) {
+		gtest.Eq(gg.Try1(parseSignal(src)), exp)
+	}
+
+	test(`SIGTERM`, syscall.SIGTERM)
+	test(`TERM`, syscall.SIGTERM)
+	test(`int`, syscall.SIGINT)
+	test(`9`, syscall.SIGKILL)
+
+	_, err := parseSignal(`SIGWHAT`)
+	gtest.ErrStr(`unknown signal "SIGWHAT"`, err)
+}
+
+func TestCmd_Stop(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var task Task
+	task.Opt.StopWait = FlagDuration(time.Millisecond * 50)
+	task.Cmd.Init(&task)
+
+	// Ignored signals are inherited, so this ignores SIGTERM in both processes.
+	cmd := exec.Command(`sh`, `-c`, `trap "" TERM; sleep 10`)
+	gg.Try(cmd.Start())
+	go cmd.Wait()
+	task.Cmd.Pid.Store(int64(cmd.Process.Pid))
+
+	// Wait for the shell to spawn "sleep".
+	var subs []int
+	for ind := 0; ind < 100 && gg.IsEmpty(subs); ind++ {
+		time.Sleep(time.Millisecond * 10)
+		subs = gg.Try1(SubPids(cmd.Process.Pid, false))
+	}
+	gtest.NotEmpty(subs)
+	pids := gg.Concat([]int{cmd.Process.Pid}, subs)
+
+	start := time.Now()
+	task.Cmd.Stop(syscall.SIGTERM)
+	gtest.LessPrim(time.Since(start), time.Second*5)
+
+	/**
+	Killed processes remain zombies until reaped. The orphaned "sleep" is reaped
+	by init, which may take a moment. Without SIGKILL, it would keep running
+	for much longer.
+	*/
+	gtest.True(awaitPids(pids, time.Second*5))
+}
+
+func TestBackoff(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var opt Opt
+	opt.Init([]string{`-bn=2`, `-bw=10s`, `-bd=1s`, `-bm=5s`, `some_command`})
+
+	var tar Backoff
+	now := time.Now()
+	fail := errors.New(`fail`)
+
+	gtest.Zero(tar.Delay(opt, now))
+
+	tar.OnExit(fail, now.Add(-time.Second*20))
+	tar.OnExit(fail, now)
+	gtest.Zero(tar.Delay(opt, now))
+
+	tar.OnExit(fail, now)
+	gtest.Eq(tar.Delay(opt, now), time.Second)
+
+	tar.OnExit(fail, now)
+	gtest.Eq(tar.Delay(opt, now), time.Second*2)
+
+	tar.OnExit(fail, now)
+	tar.OnExit(fail, now)
+	gtest.Eq(tar.Delay(opt, now), time.Second*5)
+
+	gtest.Zero(tar.Delay(opt, now.Add(time.Second*11)))
+
+	tar.OnExit(fail, now)
+	tar.OnExit(fail, now)
+	tar.OnExit(nil, now)
+	gtest.Zero(tar.Delay(opt, now))
+}
+
+func TestRestartMode(t *testing.T) {
+	defer gtest.Catch(t)
+
+	fail := errors.New(`fail`)
+
+	gtest.False(RestartModeNever.ShouldRestart(nil))
+	gtest.False(RestartModeNever.ShouldRestart(fail))
+	gtest.False(RestartModeOnFailure.ShouldRestart(nil))
+	gtest.True(RestartModeOnFailure.ShouldRestart(fail))
+	gtest.True(RestartModeAlways.ShouldRestart(nil))
+	gtest.True(RestartModeAlways.ShouldRestart(fail))
+}
+
+func TestCmd_OnExit(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var task Task
+	task.Opt.Init([]string{`--restart=on-failure`, `-rd=1ms`, `-rn=2`, `-rw=1s`, `-bw=1h`, `some_command`})
+	task.ChanRestart.InitCap(1)
+	task.Cmd.Init(&task)
+
+	fail := errors.New(`fail`)
+
+	received := func() bool {
+		select {
+		case <-task.ChanRestart:
+			return true
+		case <-time.After(time.Millisecond * 50):
+			return false
+		}
+	}
+
+	gen := task.Cmd.Gen.Load()
+	short := time.Millisecond
+	long := task.Opt.RestartWindow.Duration()
+
+	task.Cmd.OnExit(nil, short, gen)
+	gtest.False(received())
+
+	task.Cmd.OnExit(fail, short, gen)
+	gtest.True(received())
+
+	task.Cmd.OnExit(fail, short, gen)
+	gtest.True(received())
+
+	// Over the limit of consecutive restarts.
+	task.Cmd.OnExit(fail, short, gen)
+	gtest.False(received())
+
+	// A healthy run resets the count.
+	task.Cmd.OnExit(fail, long, gen)
+	gtest.True(received())
+
+	task.Cmd.OnExit(fail, short, gen)
+	gtest.True(received())
+
+	task.Cmd.OnExit(fail, short, gen)
+	gtest.False(received())
+
+	task.Cmd.Restarts.Store(0)
+	task.Cmd.OnExit(fail, short, gen)
+	task.Cmd.Gen.Add(1)
+	gtest.False(received())
+}
+
+func TestCmd_RunSteps(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, `out`)
+	done := filepath.Join(dir, `done`)
+	read := func() string { return string(gg.Try1(os.ReadFile(out))) }
+	exists := func(path string) bool { return gg.Catch(func() { gg.Try1(os.Stat(path)) }) == nil }
+
+	makeTask := func(src ...string) *Task {
+		var main Main
+		var opt Opt
+		opt.Init(src)
+		var task Task
+		task.Init(&main, ``, opt)
+		task.ChanRestart.InitCap(1)
+		return &task
+	}
+
+	{
+		task := makeTask(`-g=touch`, `--before=echo one >> `+out, `--before=echo two >> `+out, done)
+		task.Cmd.Restart()
+		<-task.Cmd.Before.Done
+		gtest.Eq(read(), "one\ntwo\n")
+		for ind := 0; ind < 100 && !exists(done); ind++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		gtest.True(exists(done))
+	}
+
+	gg.Try(os.Remove(out))
+	gg.Try(os.Remove(done))
+
+	{
+		task := makeTask(`-g=touch`, `--restart=on-failure`, `-rd=1ms`, `--before=exit 3`, `--before=echo one >> `+out, done)
+		task.Cmd.Restart()
+		<-task.Cmd.Before.Done
+
+		select {
+		case <-task.ChanRestart:
+		case <-time.After(time.Second):
+			t.Fatal(`expected a restart after a failed step`)
+		}
+		gtest.Zero(task.Cmd.Count.Load())
+		gtest.False(exists(out))
+	}
+
+	{
+		task := makeTask(`-g=touch`, `-sw=50ms`, `--before=sleep 10`, done)
+		task.Cmd.Restart()
+
+		start := time.Now()
+		task.Cmd.CancelBefore()
+		gtest.LessPrim(time.Since(start), time.Second*5)
+		gtest.Zero(task.Cmd.Count.Load())
+		gtest.False(exists(done))
+	}
+}
+
+func TestCmd_Build(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, `main.go`)
+	out := filepath.Join(dir, `out`)
+	write := func(body string) { gg.Try(os.WriteFile(src, []byte(body), os.ModePerm)) }
+	read := func() string {
+		val, _ := os.ReadFile(out)
+		return string(val)
+	}
+	await := func(exp string) {
+		for ind := 0; ind < 100 && read() != exp; ind++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		gtest.Eq(read(), exp)
+	}
+	program := func(val string) string {
+		return `package main
+
+import ("os"; "time")
+
+func main() {
+	os.WriteFile(os.Args[1], []byte("` + val + `"), os.ModePerm)
+	time.Sleep(time.Second * 10)
+}
+`
 	}
+
+	var main Main
+	var opt Opt
+	opt.Init([]string{`-b`, `-sw=1s`, `run`, src, out})
+
+	var task Task
+	task.Init(&main, ``, opt)
+	defer task.Deinit()
+
+	gtest.Equal(task.Cmd.BuildStep(opt.Args).Args, []string{
+		`go`, `build`, `-o`, filepath.Join(task.Cmd.BuildDir, `1`, `main`), src,
+	})
+
+	write(program(`one`))
+	task.Cmd.Restart()
+	<-task.Cmd.Before.Done
+	await(`one`)
+	pid := int(task.Cmd.Pid.Load())
+	gtest.NotZero(pid)
+
+	write(`package main; func main() { invalid }`)
+	task.Cmd.Restart()
+	<-task.Cmd.Before.Done
+	gtest.Eq(int(task.Cmd.Pid.Load()), pid)
+	gtest.True(isPidAlive(pid))
+
+	write(program(`two`))
+	task.Cmd.Restart()
+	<-task.Cmd.Before.Done
+	await(`two`)
+	gtest.NotEq(int(task.Cmd.Pid.Load()), pid)
+	gtest.False(isPidAlive(pid))
+
+	gtest.PanicStr(`build mode "-b" requires the "run" subcommand`, func() {
+		Opt{Build: true, Args: []string{`test`}}.Validate()
+	})
 }
 
 func testIgnore[Ignore interface {
@@ -74,6 +790,1222 @@ func testIgnore[Ignore interface {
 	}
 }
 
+func TestConfig(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	sub := filepath.Join(dir, `sub`)
+	gg.Try(os.MkdirAll(sub, os.ModePerm))
+	gg.Try(os.WriteFile(filepath.Join(dir, CONFIG_FILE), []byte(`{
+		"clear": true,
+		"exclude": ["**/*_gen.go"],
+		"include": ["db/*.sql"],
+		"extensions": ["go", "html"],
+		"ignore": ["target", "/abs"],
+		"debounce": "50ms",
+		"restart_max": 3,
+		"args": ["run", "."],
+		"profiles": {
+			"test": {"args": ["test"], "clear": false, "suffix": null}
+		}
+	}`), os.ModePerm))
+
+	conf := FindConfig(sub)
+	gtest.NotZero(conf)
+	gtest.Eq(conf.Path, filepath.Join(dir, CONFIG_FILE))
+
+	flags, args := conf.Flags(conf.Opt(``))
+	gtest.Equal(args, []string{`run`, `.`})
+	gtest.Equal(flags, []string{
+		`-c=true`,
+		`-rn=3`,
+		`-d=50ms`,
+		`-e=go`,
+		`-e=html`,
+		`--include=` + filepath.ToSlash(dir) + `/db/*.sql`,
+		`--exclude=` + filepath.ToSlash(dir) + `/**/*_gen.go`,
+		`-i=` + filepath.Join(dir, `target`),
+		`-i=/abs`,
+	})
+
+	flags, args = conf.Flags(conf.Opt(`test`))
+	gtest.Equal(args, []string{`test`})
+	gtest.Equal(flags, []string{
+		`-c=false`,
+		`-S=`,
+		`-rn=3`,
+		`-d=50ms`,
+		`-e=go`,
+		`-e=html`,
+		`--include=` + filepath.ToSlash(dir) + `/db/*.sql`,
+		`--exclude=` + filepath.ToSlash(dir) + `/**/*_gen.go`,
+		`-i=` + filepath.Join(dir, `target`),
+		`-i=/abs`,
+	})
+
+	gtest.PanicStr(`unknown profile "missing"`, func() { conf.Opt(`missing`) })
+	gtest.PanicStr(`unknown key "unknown"`, func() {
+		conf.Flags(ConfigOpt{`unknown`: json.RawMessage(`true`)})
+	})
+	gtest.PanicStr(`unsupported value`, func() {
+		conf.Flags(ConfigOpt{`clear`: json.RawMessage(`{}`)})
+	})
+
+	gtest.Zero(FindConfig(t.TempDir()))
+
+	gtest.Eq(conf.ResolveGlob(`**/*_gen.go`), filepath.ToSlash(dir)+`/**/*_gen.go`)
+	gtest.Eq(conf.ResolveGlob(`./db/*.sql`), filepath.ToSlash(dir)+`/db/*.sql`)
+	gtest.Eq(conf.ResolveGlob(`/abs/*.go`), `/abs/*.go`)
+	gtest.Eq(conf.ResolveGlob(``), ``)
+}
+
+// Globs in the config file match the same files regardless of CWD.
+func TestFindConfig_toml(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	sub := filepath.Join(dir, `sub`)
+	gg.Try(os.MkdirAll(sub, os.ModePerm))
+	gg.Try(os.WriteFile(filepath.Join(sub, CONFIG_FILE_TOML), nil, os.ModePerm))
+
+	gtest.PanicStr(`TOML is not supported`, func() { FindConfig(sub) })
+
+	// "gow.json" takes priority over "gow.toml" in the same directory.
+	gg.Try(os.WriteFile(filepath.Join(sub, CONFIG_FILE), []byte(`{}`), os.ModePerm))
+	gtest.Eq(FindConfig(sub).Path, filepath.Join(sub, CONFIG_FILE))
+}
+
+func TestConfig_globs(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	sub := filepath.Join(dir, `sub`)
+	gg.Try(os.MkdirAll(sub, os.ModePerm))
+	gg.Try(os.WriteFile(filepath.Join(dir, CONFIG_FILE), []byte(`{
+		"include": ["sub/*.sql"],
+		"exclude": ["**/*_gen.go"]
+	}`), os.ModePerm))
+
+	for _, val := range []string{dir, sub} {
+		var opt Opt
+		opt.Env = testOptEnv(nil, val)
+		opt.Init([]string{`some_command`})
+
+		msg := fmt.Sprintf(`dir: %q`, val)
+		gtest.True(opt.AllowFile(filepath.Join(sub, `one.sql`)), msg)
+		gtest.False(opt.AllowFile(filepath.Join(dir, `one.sql`)), msg)
+		gtest.True(opt.AllowFile(filepath.Join(sub, `one.go`)), msg)
+		gtest.False(opt.AllowFile(filepath.Join(sub, `one_gen.go`)), msg)
+	}
+}
+
+/*
+Path rules from the config file apply in a fixed order: extensions, includes,
+excludes. Extensions and includes from env vars and CLI flags don't cancel the
+excludes from the config file, but "--exclude" replaces them.
+*/
+func TestConfig_pathRules(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	env := map[string]string{}
+	gg.Try(os.WriteFile(filepath.Join(dir, CONFIG_FILE), []byte(`{
+		"exclude": ["**/*_gen.go"],
+		"extensions": ["go"]
+	}`), os.ModePerm))
+
+	test := func(src []string, path string, exp bool) {
+		var opt Opt
+		opt.Env = testOptEnv(env, dir)
+		opt.Init(append(src, `some_command`))
+		msg := fmt.Sprintf(`args: %q; env: %q; path: %q`, src, env, path)
+		gtest.Eq(opt.AllowFile(filepath.Join(dir, path)), exp, msg)
+	}
+
+	test(nil, `one.go`, true)
+	test(nil, `one_gen.go`, false)
+	test(nil, `one.sql`, false)
+
+	test([]string{`-e=go`}, `one.go`, true)
+	test([]string{`-e=go`}, `one_gen.go`, false)
+	test([]string{`-e=go,sql`}, `one.sql`, true)
+	test([]string{`--include=**/*.go`}, `one_gen.go`, false)
+	test([]string{`--exclude=`, `-e=go`}, `one_gen.go`, true)
+	test([]string{`--exclude=**/two.go`}, `one_gen.go`, true)
+	test([]string{`--exclude=**/two.go`}, `two.go`, false)
+
+	env[`GOW_EXTENSIONS`] = `go,sql`
+	test(nil, `one_gen.go`, false)
+	test(nil, `one.sql`, true)
+	test([]string{`-e=go`}, `one_gen.go`, false)
+	test([]string{`-e=go`}, `one.sql`, false)
+}
+
+func Test_splitProfiles(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(src, expProfiles, expArgs []string) {
+		profiles, args := splitProfiles(src)
+		gtest.Equal(profiles, expProfiles)
+		gtest.Equal(args, expArgs)
+	}
+
+	test(nil, nil, nil)
+	test([]string{`run`, `.`}, nil, []string{`run`, `.`})
+	test([]string{`@one`}, []string{`one`}, []string{})
+	test([]string{`@one`, `run`, `@two`}, []string{`one`}, []string{`run`, `@two`})
+}
+
+func Test_dropFlags(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.Equal(
+		dropFlags(
+			[]string{`-c=true`, `-e=go`, `-e=html`, `-v=true`},
+			gg.SetOf(`-e`, `-v`),
+		),
+		[]string{`-c=true`},
+	)
+}
+
+func TestEnvFlags(t *testing.T) {
+	defer gtest.Catch(t)
+
+	env := map[string]string{
+		`GOW_CLEAR`:      `1`,
+		`GOW_RAW`:        `0`,
+		`GOW_EXTENSIONS`: `go,mod,sql`,
+		`GOW_STOP_WAIT`:  `1s`,
+		`GOW_HELP`:       `true`,
+		`GOW_ARGS`:       `run`,
+	}
+
+	gtest.Equal(
+		EnvFlags(func(key string) (string, bool) {
+			val, ok := env[key]
+			return val, ok
+		}),
+		[]string{`-c=true`, `-r=false`, `-sw=1s`, `-e=go,mod,sql`},
+	)
+
+	gtest.PanicStr(`invalid value "yes" of environment variable "GOW_LAZY"`, func() {
+		EnvFlags(func(key string) (string, bool) { return `yes`, key == `GOW_LAZY` })
+	})
+}
+
+func TestOpt_Parse_sources(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var opt Opt
+	opt.Env = testOptEnv(map[string]string{
+		`GOW_CLEAR`:      `1`,
+		`GOW_VERBOSE`:    `0`,
+		`GOW_EXTENSIONS`: `go,sql`,
+	}, t.TempDir())
+	gtest.NoErr(opt.Parse([]string{`-e=html`, `-e=css`, `run`, `.`}))
+
+	gtest.Equal(opt.Args, []string{`run`, `.`})
+	gtest.True(opt.ClearHard)
+	gtest.False(opt.Verb)
+	gtest.Equal(opt.Extensions.Vals, []string{`html`, `css`})
+	gtest.Eq(opt.Cmd, `go`)
+
+	gtest.Eq(opt.Sources.Get(`-c`), OptSourceEnv)
+	gtest.Eq(opt.Sources.Get(`-v`), OptSourceEnv)
+	gtest.Eq(opt.Sources.Get(`-e`), OptSourceCli)
+	gtest.Eq(opt.Sources.Get(`-g`), OptSourceDefault)
+}
+
+func Test_compactDirs(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.Equal(compactDirs([]string{`.`}), []string{`.`})
+	gtest.Equal(compactDirs([]string{`.`, `.`, cwd}), []string{`.`})
+	gtest.Equal(compactDirs([]string{`one/two`, `one`, `three`}), []string{`one`, `three`})
+	gtest.Equal(compactDirs([]string{`one`, `one_two`}), []string{`one`, `one_two`})
+	gtest.Equal(compactDirs([]string{`one`, `.`}), []string{`.`})
+}
+
+func TestLineWriter(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var buf gg.Buf
+	tar := NewLineWriter(&buf, `[one] `)
+
+	gg.Nop2(tar.Write([]byte(`two`)))
+	gtest.Zero(buf.String())
+
+	gg.Nop2(tar.Write([]byte("three\nfour\n\nfive")))
+	gtest.Eq(buf.String(), "[one] twothree\n[one] four\n[one] \n")
+
+	tar.Flush()
+	gtest.Eq(buf.String(), "[one] twothree\n[one] four\n[one] \n[one] five\n")
+
+	tar.Flush()
+	gtest.Eq(buf.String(), "[one] twothree\n[one] four\n[one] \n[one] five\n")
+}
+
+// In lazy mode, FS events restart the subprocess only when it's not running.
+func TestTask_ShouldRestart_lazy(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var main Main
+	var task Task
+	task.Init(&main, ``, OptDefault())
+	defer task.Deinit()
+	task.Opt.Lazy = true
+
+	event := TestFsEvent(filepath.Join(cwd, `one.go`))
+	gtest.False(task.Cmd.IsRunning())
+	gtest.True(task.ShouldRestart(event))
+
+	task.Cmd.Count.Add(1)
+	defer task.Cmd.Count.Add(-1)
+	gtest.True(task.Cmd.IsRunning())
+	gtest.False(task.ShouldRestart(event))
+}
+
+func TestTask_Watches(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var main Main
+	main.Opt.WatchDirs = FlagWatchDirs{`one`, `two`}
+
+	var task Task
+	task.Init(&main, `one`, OptDefault())
+	task.Opt.WatchDirs = FlagWatchDirs{`one`}
+
+	gtest.True(task.Watches(filepath.Join(cwd, `one/file.go`)))
+	gtest.False(task.Watches(filepath.Join(cwd, `two/file.go`)))
+
+	task.Opt.WatchDirs = main.Opt.WatchDirs
+	gtest.True(task.Watches(filepath.Join(cwd, `two/file.go`)))
+}
+
+func TestOpt_Parse_profiles(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var opt Opt
+	gtest.ErrStr(
+		`unexpected args ["vet"]: multiple profiles ["one" "two"] must provide their own "args"`,
+		opt.Parse([]string{`-v`, `@one`, `@two`, `vet`}),
+	)
+}
+
+func TestEvents(t *testing.T) {
+	defer gtest.Catch(t)
+
+	path := filepath.Join(t.TempDir(), `events.ndjson`)
+
+	var main Main
+	main.Events.Init(path)
+
+	opt := OptDefault()
+	opt.Cmd = `sh`
+	opt.Args = []string{`-c`, `exit 3`}
+
+	var task Task
+	task.Init(&main, `one`, opt)
+	task.OnFsEvent(PollEvent{`write`, filepath.Join(cwd, `file.go`)})
+	task.Cmd.Restart()
+
+	for task.Cmd.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+	main.Events.Deinit()
+	main.Events.Send(Event{Type: EventTypeHotkey})
+
+	var events []Event
+	for _, line := range gg.SplitLines(gg.ReadFile[string](path)) {
+		if line != `` {
+			var val Event
+			gg.JsonDecode(line, &val)
+			if val.Type == EventTypeReady {
+				continue
+			}
+			gtest.NotZero(val.Time)
+			val.Time = time.Time{}
+			val.Duration = 0
+			events = append(events, val)
+		}
+	}
+
+	gtest.Eq(len(events), 4)
+	gtest.NotZero(events[2].Pid)
+	gtest.Eq(events[3].Pid, events[2].Pid)
+	events[2].Pid = 0
+	events[3].Pid = 0
+
+	gtest.Equal(events, []Event{
+		{Type: EventTypeFsEvent, Task: `one`, Path: filepath.Join(cwd, `file.go`), Op: `write`},
+		{Type: EventTypeRestart, Task: `one`, Reason: `fs`, Paths: []string{filepath.Join(cwd, `file.go`)}},
+		{Type: EventTypeStart, Task: `one`, Args: []string{`sh`, `-c`, `exit 3`}},
+		{Type: EventTypeExit, Task: `one`, Code: gg.Ptr(3), Error: `exit status 3`},
+	})
+}
+
+func Test_exitEvent(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(err error, exp Event) {
+		exp.Type = EventTypeExit
+		exp.Pid = 1
+		exp.Duration = 2
+		gtest.Equal(exitEvent(1, err, time.Millisecond*2), exp)
+	}
+
+	test(nil, Event{Code: gg.Ptr(0)})
+	test(exec.Command(`sh`, `-c`, `exit 1`).Run(), Event{Code: gg.Ptr(1), Error: `exit status 1`})
+	test(exec.Command(`sh`, `-c`, `kill -TERM $$`).Run(), Event{Signal: `SIGTERM`, Error: `signal: terminated`})
+	test(errors.New(`some error`), Event{Error: `some error`})
+}
+
+func TestEvents_unix(t *testing.T) {
+	defer gtest.Catch(t)
+
+	path := filepath.Join(t.TempDir(), `events.sock`)
+	lis := gg.Try1(net.Listen(`unix`, path))
+	defer lis.Close()
+
+	var events Events
+	events.Init(`unix:` + path)
+	defer events.Deinit()
+
+	conn := gg.Try1(lis.Accept())
+	defer conn.Close()
+
+	events.Send(Event{Type: EventTypeHotkey, Key: `^R`, Action: `restart`})
+
+	line := gg.Try1(bufio.NewReader(conn).ReadString('\n'))
+	var val Event
+	gg.JsonDecode(line, &val)
+	gtest.Eq(val.Key, `^R`)
+	gtest.Eq(val.Action, `restart`)
+
+	gtest.PanicStr(`unable to open event stream "fd:one"`, func() {
+		new(Events).Init(`fd:one`)
+	})
+}
+
+// Inherited file descriptors are not closed. See `EventsFd`.
+func TestEvents_fd(t *testing.T) {
+	defer gtest.Catch(t)
+
+	read, write := gg.Try2(os.Pipe())
+	defer read.Close()
+	defer write.Close()
+
+	var events Events
+	events.Init(`fd:` + strconv.Itoa(int(write.Fd())))
+	events.Send(Event{Type: EventTypeHotkey, Key: `^R`})
+	events.Deinit()
+
+	gg.Try1(write.Write([]byte("after\n")))
+
+	buf := bufio.NewReader(read)
+	gtest.TextHas(gg.Try1(buf.ReadString('\n')), `"key":"^R"`)
+	gtest.Eq(gg.Try1(buf.ReadString('\n')), "after\n")
+
+	gtest.Eq(fdFile(1, `fd:1`), os.Stdout)
+	gtest.Eq(fdFile(2, `fd:2`), os.Stderr)
+}
+
+// A stalled reader blocks neither senders nor `Events.Deinit`.
+func TestEvents_stalled(t *testing.T) {
+	defer gtest.Catch(t)
+
+	path := filepath.Join(t.TempDir(), `events.sock`)
+	lis := gg.Try1(net.Listen(`unix`, path))
+	defer lis.Close()
+
+	var events Events
+	events.Timeout = time.Millisecond * 50
+	events.Init(`unix:` + path)
+	defer events.Deinit()
+
+	conn := gg.Try1(lis.Accept())
+	defer conn.Close()
+
+	start := time.Now()
+	key := strings.Repeat(`x`, 1024)
+	for range EVENTS_QUEUE * 8 {
+		events.Send(Event{Type: EventTypeHotkey, Key: key})
+	}
+	gtest.True(time.Since(start) < time.Second)
+
+	// The write deadline disables the stream.
+	for events.IsActive() {
+		time.Sleep(time.Millisecond)
+	}
+	events.Send(Event{Type: EventTypeHotkey})
+	events.Deinit()
+}
+
+func TestApi(t *testing.T) {
+	defer gtest.Catch(t)
+
+	opt := OptDefault()
+	opt.Cmd = `sh`
+	opt.Args = []string{`-c`, `sleep 10`}
+
+	var main Main
+	var task Task
+	task.Init(&main, ``, opt)
+	defer task.Deinit()
+	main.Tasks = []*Task{&task}
+
+	var api Api
+	api.Init(&main)
+	han := api.Handler()
+
+	req := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		han.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	status := func() (out ApiStatus) {
+		rec := req(http.MethodGet, `/status`)
+		gtest.Eq(rec.Code, http.StatusOK)
+		gg.JsonDecode(rec.Body.String(), &out)
+		return
+	}
+
+	task.Cmd.Restart()
+	val := status()
+	gtest.Eq(val.Pid, os.Getpid())
+	gtest.Eq(len(val.Tasks), 1)
+	gtest.True(val.Tasks[0].Running)
+	gtest.NotZero(val.Tasks[0].Pid)
+	gtest.Equal(val.Tasks[0].Args, []string{`sh`, `-c`, `sleep 10`})
+	gtest.Zero(val.Tasks[0].LastExit)
+
+	gtest.Eq(req(http.MethodPost, `/signal/BOGUS`).Code, http.StatusBadRequest)
+	gtest.Eq(req(http.MethodPost, `/stop?task=bogus`).Code, http.StatusNotFound)
+	gtest.Eq(req(http.MethodGet, `/stop`).Code, http.StatusMethodNotAllowed)
+
+	gtest.Eq(req(http.MethodPost, `/stop`).Code, http.StatusOK)
+	for task.Cmd.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+
+	val = status()
+	gtest.False(val.Tasks[0].Running)
+	gtest.Zero(val.Tasks[0].Pid)
+	gtest.NotZero(val.Tasks[0].LastExit)
+	gtest.Eq(val.Tasks[0].LastExit.Signal, `SIGTERM`)
+
+	// A subprocess which ignores the stop signal is killed after `Opt.StopWait`.
+	task.Opt.Args = []string{`-c`, `trap "" TERM; sleep 10`}
+	task.Opt.StopWait = FlagDuration(time.Millisecond * 50)
+	task.Cmd.Restart()
+	time.Sleep(time.Millisecond * 50)
+	gtest.Eq(req(http.MethodPost, `/stop`).Code, http.StatusOK)
+	for task.Cmd.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+	gtest.Eq(status().Tasks[0].LastExit.Signal, `SIGKILL`)
+
+	gtest.False(task.Pending.IsManual())
+	gtest.Eq(req(http.MethodPost, `/restart`).Code, http.StatusAccepted)
+	gtest.True(task.Pending.IsManual())
+
+	gtest.False(status().Paused)
+	gtest.Eq(req(http.MethodPost, `/pause`).Code, http.StatusAccepted)
+	gtest.True(main.Paused.Load())
+	gtest.True(status().Paused)
+	gtest.Eq(req(http.MethodPost, `/resume`).Code, http.StatusAccepted)
+	gtest.False(main.Paused.Load())
+}
+
+func Test_loopbackAddr(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(src, exp string) { gtest.Eq(gg.Try1(loopbackAddr(src)), exp) }
+	test(`:7070`, `127.0.0.1:7070`)
+	test(`localhost:7070`, `localhost:7070`)
+	test(`127.0.0.2:7070`, `127.0.0.2:7070`)
+	test(`[::1]:7070`, `[::1]:7070`)
+
+	fail := func(src, exp string) { gtest.ErrStr(exp, gg.Catch(func() { gg.Try1(loopbackAddr(src)) })) }
+	fail(`0.0.0.0:7070`, `not a loopback address`)
+	fail(`example.com:7070`, `not a loopback address`)
+	fail(`7070`, `missing port`)
+}
+
+func Test_listenApi_stale(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, `gow.sock`)
+
+	// Simulates a socket left over from a `gow` which didn't exit cleanly.
+	prev := gg.Try1(net.ListenUnix(`unix`, &net.UnixAddr{Name: path, Net: `unix`}))
+	prev.SetUnlinkOnClose(false)
+	gg.Try(prev.Close())
+
+	lis := gg.Try1(listenApi(path))
+	defer lis.Close()
+
+	_, err := listenApi(`unix:` + path)
+	gtest.ErrStr(`another process is already listening`, err)
+
+	// Other files are never replaced.
+	file := filepath.Join(dir, `go.mod`)
+	gg.Try(os.WriteFile(file, []byte(`module one`), os.ModePerm))
+
+	_, err = listenApi(`unix:` + file)
+	gtest.ErrStr(`which is not a socket`, err)
+	gtest.Eq(string(gg.Try1(os.ReadFile(file))), `module one`)
+}
+
+func TestApi_Guard(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var api Api
+	api.Listener = gg.Try1(net.Listen(`tcp`, `127.0.0.1:0`))
+	defer api.Listener.Close()
+
+	han := api.Guard(http.HandlerFunc(func(rew http.ResponseWriter, _ *http.Request) {
+		rew.WriteHeader(http.StatusAccepted)
+	}))
+
+	test := func(host, origin string, exp int) {
+		req := httptest.NewRequest(http.MethodPost, `/restart`, nil)
+		req.Host = host
+		if origin != `` {
+			req.Header.Set(`Origin`, origin)
+		}
+		rec := httptest.NewRecorder()
+		han.ServeHTTP(rec, req)
+		gtest.Eq(rec.Code, exp)
+	}
+
+	test(`localhost:7070`, ``, http.StatusAccepted)
+	test(`127.0.0.1:7070`, ``, http.StatusAccepted)
+	test(`[::1]:7070`, ``, http.StatusAccepted)
+	test(`localhost:7070`, `http://example.com`, http.StatusForbidden)
+	test(`example.com:7070`, ``, http.StatusForbidden)
+
+	// Over a unix socket, the host is arbitrary.
+	api.Listener = nil
+	test(`gow`, ``, http.StatusAccepted)
+	test(`gow`, `http://example.com`, http.StatusForbidden)
+}
+
+func TestReload(t *testing.T) {
+	defer gtest.Catch(t)
+
+	lis := gg.Try1(net.Listen(`tcp`, `127.0.0.1:0`))
+	defer lis.Close()
+
+	var main Main
+	main.Opt.Reload = `127.0.0.1:0`
+
+	var unready Task
+	unready.Init(&main, `unready`, OptDefault())
+	main.Tasks = []*Task{&unready}
+
+	gtest.PanicStr(`live reload "--reload" requires a readiness probe "--ready"`, func() {
+		main.Reload.Init(&main)
+	})
+
+	opt := OptDefault()
+	gg.Try(opt.Ready.Parse(lis.Addr().String()))
+
+	var task Task
+	task.Init(&main, `ready`, opt)
+	task.Cmd.Pid.Store(1)
+	main.Tasks = append(main.Tasks, &task)
+
+	main.Reload.Init(&main)
+	defer main.Reload.Deinit()
+	go main.Reload.Run()
+
+	url := `http://` + main.Reload.Listener.Addr().String()
+
+	res := gg.Try1(http.Get(url + `/reload.js`))
+	defer res.Body.Close()
+	gtest.Eq(res.StatusCode, http.StatusOK)
+	gtest.Eq(string(gg.Try1(io.ReadAll(res.Body))), RELOAD_SCRIPT)
+
+	res = gg.Try1(http.Get(url + `/events`))
+	defer res.Body.Close()
+	gtest.Eq(res.Header.Get(`Content-Type`), `text/event-stream`)
+
+	// The server registers the client before sending the headers.
+	main.Reload.Lock.Lock()
+	clients := main.Reload.Clients.Slice()
+	main.Reload.Lock.Unlock()
+	gtest.Eq(len(clients), 1)
+
+	// Without probes, the task is ready too early to reload browsers.
+	unready.Cmd.Pid.Store(1)
+	unready.Cmd.AwaitReady(1, nil)
+	gtest.Zero(len(clients[0]))
+
+	// Not the current subprocess: gives up without reloading.
+	task.Cmd.AwaitReady(2, nil)
+	gtest.Zero(len(clients[0]))
+
+	task.Cmd.AwaitReady(1, nil)
+	read := bufio.NewReader(res.Body)
+	gtest.Eq(gg.Try1(read.ReadString('\n')), "event: reload\n")
+	gtest.Eq(gg.Try1(read.ReadString('\n')), "data: {}\n")
+	gtest.Eq(gg.Try1(read.ReadString('\n')), "\n")
+}
+
+func Test_parseReadyProbe(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(src string, exp ReadyProbe) {
+		exp.Src = src
+		gtest.Equal(gg.Try1(parseReadyProbe(src)), exp)
+	}
+	test(`localhost:8080`, ReadyProbe{Tcp: `localhost:8080`})
+	test(`tcp::8080`, ReadyProbe{Tcp: `:8080`})
+	test(`http://localhost:8080/health`, ReadyProbe{Http: `http://localhost:8080/health`})
+	test(`https://localhost/health`, ReadyProbe{Http: `https://localhost/health`})
+	test(`log:listening on \d+`, ReadyProbe{Log: regexp.MustCompile(`listening on \d+`)})
+
+	fail := func(src, exp string) {
+		_, err := parseReadyProbe(src)
+		gtest.ErrStr(exp, err)
+	}
+	fail(`8080`, `invalid readiness probe "8080"`)
+	fail(`log:(`, `invalid readiness probe "log:("`)
+}
+
+func TestReadyLog(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var ready FlagReady
+	gg.Try(ready.Parse(`localhost:8080`))
+	gtest.Zero(NewReadyLog(ready))
+
+	gg.Try(ready.Parse(`log:^listening$`))
+	gg.Try(ready.Parse(`log:connected`))
+	tar := NewReadyLog(ready)
+	one, two := ready[1].Log, ready[2].Log
+
+	gg.Nop2(tar.Write([]byte("starting\nlisten")))
+	gtest.False(tar.Has(one))
+
+	gg.Nop2(tar.Write([]byte("ing")))
+	gtest.False(tar.Has(one))
+
+	gg.Nop2(tar.Write([]byte("\ndb connected\n")))
+	gtest.True(tar.Has(one))
+	gtest.True(tar.Has(two))
+}
+
+func TestCmd_AwaitReady(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var ok atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(rew http.ResponseWriter, _ *http.Request) {
+		if !ok.Load() {
+			rew.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	opt := OptDefault()
+	opt.Cmd = `sh`
+	opt.Args = []string{`-c`, `echo starting; sleep 0.1; echo listening; sleep 10`}
+	gg.Try(opt.Ready.Parse(`log:listening`))
+	gg.Try(opt.Ready.Parse(srv.URL))
+
+	var main Main
+	var task Task
+	task.Init(&main, ``, opt)
+	defer task.Deinit()
+
+	task.Cmd.Restart()
+	pid := task.Cmd.Pid.Load()
+
+	time.Sleep(time.Millisecond * 200)
+	gtest.Zero(task.Cmd.ReadyPid.Load())
+
+	ok.Store(true)
+	for ind := 0; ind < 100 && task.Cmd.ReadyPid.Load() == 0; ind++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	gtest.Eq(task.Cmd.ReadyPid.Load(), pid)
+
+	// Gives up after the timeout. A separate task avoids modifying the options
+	// of the previous one while its goroutines are still running.
+	opt.Ready = nil
+	gg.Try(opt.Ready.Parse(`log:never`))
+	opt.ReadyTimeout = FlagDuration(time.Millisecond * 50)
+
+	var other Task
+	other.Init(&main, ``, opt)
+	defer other.Deinit()
+
+	other.Cmd.Restart()
+	time.Sleep(time.Millisecond * 150)
+	gtest.True(other.Cmd.IsRunning())
+	gtest.Zero(other.Cmd.ReadyPid.Load())
+}
+
+func TestProxy(t *testing.T) {
+	defer gtest.Catch(t)
+
+	// Reserve a port for the server, which starts later.
+	lis := gg.Try1(net.Listen(`tcp`, `127.0.0.1:0`))
+	addr := lis.Addr().String()
+	gg.Try(lis.Close())
+
+	/**
+	Each scenario uses a separate task. Options are read by the proxy and the
+	subprocess goroutines, and must not be modified while they're running.
+	*/
+	var main Main
+	newTask := func(timeout time.Duration) *Task {
+		opt := OptDefault()
+		opt.Cmd = `sh`
+		opt.Args = []string{`-c`, `echo 'some <error>' >&2; exit 2`}
+		opt.Proxy = `127.0.0.1:0`
+		opt.ProxyTo = addr
+		opt.ReadyTimeout = FlagDuration(timeout)
+
+		task := new(Task)
+		task.Init(&main, ``, opt)
+		go task.Proxy.Run()
+		return task
+	}
+	get := func(task *Task) (int, string) {
+		res := gg.Try1(http.Get(`http://` + task.Proxy.Listener.Addr().String()))
+		defer res.Body.Close()
+		return res.StatusCode, string(gg.Try1(io.ReadAll(res.Body)))
+	}
+
+	task := newTask(time.Second * 30)
+	defer task.Deinit()
+
+	type Res struct {
+		Code int
+		Body string
+	}
+	var out gg.Chan[Res]
+	out.InitCap(1)
+	go func() {
+		code, body := get(task)
+		out.Send(Res{code, body})
+	}()
+
+	// Held until ready.
+	time.Sleep(time.Millisecond * 50)
+	gtest.Zero(len(out))
+	task.Proxy.Resume()
+
+	// Refused connections are retried until the server listens.
+	time.Sleep(time.Millisecond * 50)
+	gtest.Zero(len(out))
+
+	srv := http.Server{Handler: http.HandlerFunc(func(rew http.ResponseWriter, req *http.Request) {
+		gg.Nop2(rew.Write([]byte(`host: ` + req.Host)))
+	})}
+	go srv.Serve(gg.Try1(net.Listen(`tcp`, addr)))
+	defer srv.Close()
+
+	gtest.Equal(out.Receive(), Res{http.StatusOK, `host: ` + task.Proxy.Listener.Addr().String()})
+
+	short := newTask(time.Millisecond * 10)
+	defer short.Deinit()
+	code, body := get(short)
+	gtest.Eq(code, http.StatusGatewayTimeout)
+	gtest.TextHas(body, `subprocess not ready after 10ms`)
+
+	// The subprocess fails on its own: the page shows the tail of stderr.
+	failing := newTask(time.Second)
+	defer failing.Deinit()
+	failing.Cmd.Restart()
+	for failing.Cmd.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+
+	code, body = get(failing)
+	gtest.Eq(code, http.StatusBadGateway)
+	gtest.TextHas(body, `subprocess exited: exit status 2`)
+	gtest.TextHas(body, `some &lt;error&gt;`)
+
+	failing.Proxy.Resume()
+	code, body = get(failing)
+	gtest.Eq(code, http.StatusOK)
+	gtest.Eq(body, `host: `+failing.Proxy.Listener.Addr().String())
+}
+
+// In build mode, a failed build keeps forwarding to the previous subprocess.
+func TestProxy_build(t *testing.T) {
+	defer gtest.Catch(t)
+
+	opt := OptDefault()
+	opt.Build = true
+	opt.Proxy = `127.0.0.1:0`
+	opt.ProxyTo = `127.0.0.1:1`
+
+	var main Main
+	var task Task
+	task.Init(&main, ``, opt)
+	defer task.Deinit()
+
+	steps := []Step{{Desc: `fail`, Args: []string{`sh`, `-c`, `exit 1`}}}
+	fail := func() *ProxyFail {
+		gtest.False(task.Cmd.runSteps(context.Background(), task.Cmd.Gen.Load(), steps))
+		_, out := task.Proxy.state()
+		return out
+	}
+
+	task.Cmd.Count.Add(1)
+	gtest.Zero(fail())
+
+	task.Cmd.Count.Add(-1)
+	gtest.NotZero(fail())
+}
+
+func TestTailBuf(t *testing.T) {
+	defer gtest.Catch(t)
+
+	tar := TailBuf{Max: 4}
+	gg.Nop2(tar.Write([]byte(`abc`)))
+	gtest.Eq(tar.String(), `abc`)
+	gg.Nop2(tar.Write([]byte(`def`)))
+	gtest.Eq(tar.String(), `cdef`)
+	gtest.Zero((*TailBuf)(nil).String())
+}
+
+func TestPty(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var out TailBuf
+	out.Max = 1 << 10
+	pty, err := OpenPty(&out)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	gtest.NoErr(err)
+
+	cmd := exec.Command(`sh`, `-c`, `test -t 0 && test -t 1 && test -t 2 && echo tty; read line; echo "got $line"`)
+	pty.Attach(cmd)
+	gtest.NoErr(cmd.Start())
+	go pty.Run()
+
+	pty.Send([]byte("hello\n"))
+	gtest.NoErr(cmd.Wait())
+	pty.Deinit()
+
+	gtest.TextHas(out.String(), `tty`)
+	gtest.TextHas(out.String(), `got hello`)
+}
+
+func TestStdio_OnInput(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var main Main
+	var task Task
+	task.Init(&main, ``, OptDefault())
+	defer task.Deinit()
+	main.Tasks = []*Task{&task}
+
+	var stdio Stdio
+	stdio.Init(&main)
+
+	test := func(mode StdinMode, src string, exp string) {
+		pipe, err := OpenPipe()
+		gtest.NoErr(err)
+		defer pipe.Deinit()
+		task.Cmd.SetInput(Input{Pipe: pipe})
+		defer task.Cmd.SetInput(Input{})
+
+		main.Opt.Stdin = mode
+		stdio.Line = nil
+		var dec KeyDecoder
+		stdio.OnKeys(dec.Decode([]byte(src)))
+		gtest.NoErr(pipe.Write.Close())
+
+		out, err := io.ReadAll(pipe.Read)
+		gtest.NoErr(err)
+		gtest.Eq(string(out), exp)
+	}
+
+	test(StdinModePipe, "one\n", "one\n")
+	test(StdinModeLine, "one\ntwo", "one\n")
+	test(StdinModeLine, "one\x7f\x7fe\n", "oe\n")
+	test(StdinModeLine, "ünï\x7f\n", "ün\n")
+	test(StdinModeLine, "a\x1b[Db\n", "ab\n")
+	test(StdinModePipe, "a\x1b[Dü", "a\x1b[Dü")
+
+	// Lines completed while no subprocess is running are dropped.
+	stdio.Line = nil
+	stdio.OnKey(`a`)
+	stdio.OnKey("\n")
+	gtest.Zero(stdio.Line)
+}
+
+func Test_parseKeyBinding(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(src, key, action string) {
+		val, err := parseKeyBinding(src)
+		gtest.NoErr(err)
+		gtest.Eq(val.Key, key)
+		if action == `` {
+			gtest.Zero(val.Action)
+		} else {
+			gtest.Eq(val.Action.Name, action)
+		}
+	}
+
+	test(`^L:clear`, "\x0c", `clear`)
+	test(`^l:clear`, "\x0c", `clear`)
+	test(`^?:restart`, "\x7f", `restart`)
+	test(`^\:quit`, "\x1c", `quit`)
+	test(`12:clear`, "\x0c", `clear`)
+	test(`p:toggle_pause`, `p`, `toggle_pause`)
+	test(`::print_help`, `:`, `print_help`)
+	test(`space:restart`, ` `, `restart`)
+	test(`^R:`, "\x12", ``)
+
+	fail := func(src, msg string) {
+		_, err := parseKeyBinding(src)
+		gtest.ErrStr(msg, err)
+	}
+
+	fail(`clear`, `invalid hotkey binding "clear"`)
+	fail(`:clear`, `invalid hotkey binding ":clear"`)
+	fail(`^1:clear`, `invalid hotkey "^1"`)
+	fail(`128:clear`, `invalid hotkey "128"`)
+	fail(`ab:clear`, `invalid hotkey "ab"`)
+	fail(`^L:unknown`, `unknown hotkey action "unknown"`)
+}
+
+func TestHotkeys(t *testing.T) {
+	defer gtest.Catch(t)
+
+	tar := NewHotkeys(FlagKeys{
+		{"\x12", actionByName(`stop`)},
+		{"\x14", nil},
+		{"\x0c", actionByName(`clear`)},
+	})
+
+	gtest.Eq(tar.Get("\x03").Name, `interrupt`)
+	gtest.Eq(tar.Get("\x12").Name, `stop`)
+	gtest.Zero(tar.Get("\x14"))
+	gtest.Eq(tar.Get("\x0c").Name, `clear`)
+	gtest.Zero(tar.Get(`x`))
+
+	// Overriding doesn't affect the defaults.
+	gtest.Eq(DEFAULT_KEYS.Get("\x12").Name, `restart`)
+	gtest.Eq(DEFAULT_KEYS.Get("\x14").Name, `stop`)
+
+	help := tar.Help()
+	gtest.TextHas(help, "\t3     ^C          Kill subprocess with SIGINT.")
+	gtest.TextHas(help, "\t18    ^R          Kill subprocess with SIGTERM. Repeat")
+	gtest.TextHas(help, "\t12    ^L          Clear terminal.")
+	gtest.TextHas(help, "\t16    ^P          Pause or resume watching;")
+	gtest.TextHas(help, "\t127   ^?          Print hotkey help.")
+	gtest.False(strings.Contains(help, `^T`))
+}
+
+func TestKeyDecoder(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var dec KeyDecoder
+
+	gtest.Equal(
+		dec.Decode([]byte("a\x03\x1b[A\x1bOP\x1b[15;5~\x1bxü\x1b\x1b[Z")),
+		[]string{`a`, "\x03", "\x1b[A", "\x1bOP", "\x1b[15;5~", "\x1bx", `ü`, "\x1b", "\x1b[Z"},
+	)
+	gtest.False(dec.IsPending())
+
+	// Keys split between reads.
+	gtest.Zero(dec.Decode([]byte("\x1b[1")))
+	gtest.True(dec.IsPending())
+	gtest.Equal(dec.Decode([]byte(";5Ab\xc3")), []string{"\x1b[1;5A", `b`})
+	gtest.Equal(dec.Decode([]byte("\xbc")), []string{`ü`})
+
+	// Lone escape, resolved via timeout.
+	gtest.Zero(dec.Decode([]byte("\x1b")))
+	gtest.Equal(dec.Flush(), []string{"\x1b"})
+	gtest.Zero(dec.Flush())
+
+	// Invalid UTF-8 and malformed sequences.
+	gtest.Equal(dec.Decode([]byte("\xff\x1b[1\x03")), []string{"\xff", "\x1b[1", "\x03"})
+}
+
+func Test_keyName(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(key, exp string) { gtest.Eq(keyName(key), exp, key) }
+
+	test("\x03", `^C`)
+	test("\x7f", `^?`)
+	test("\x1b", `esc`)
+	test(` `, `space`)
+	test(`x`, `x`)
+	test(`ü`, `ü`)
+	test("\x1b[A", `up`)
+	test("\x1bOA", `up`)
+	test("\x1b[1;5D", `ctrl+left`)
+	test("\x1b[H", `home`)
+	test("\x1b[1~", `home`)
+	test("\x1b[7~", `home`)
+	test("\x1bOP", `f1`)
+	test("\x1b[11~", `f1`)
+	test("\x1b[15~", `f5`)
+	test("\x1b[15;2~", `shift+f5`)
+	test("\x1b[24;7~", `ctrl+alt+f12`)
+	test("\x1b[3~", `delete`)
+	test("\x1b[Z", `shift+tab`)
+	test("\x1bx", `alt+x`)
+	test("\x1b\x03", `alt+^C`)
+	test("\x1b[", `alt+[`)
+	test("\x1b[99~", `"\x1b[99~"`)
+	test("\xff", `"\xff"`)
+}
+
+func Test_parseKey(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(src, exp string) {
+		key, err := parseKey(src)
+		gtest.NoErr(err)
+		gtest.Eq(keyName(key), exp, src)
+	}
+
+	test(`^l`, `^L`)
+	test(`12`, `^L`)
+	test(`127`, `^?`)
+	test(`1`, `1`)
+	test(`alt+1`, `alt+1`)
+	test(`ctrl+l`, `^L`)
+	test(`ü`, `ü`)
+	test(`esc`, `esc`)
+	test(`up`, `up`)
+	test(`F5`, `f5`)
+	test(`f12`, `f12`)
+	test(`pgdn`, `pgdn`)
+	test(`ctrl+up`, `ctrl+up`)
+	test(`Shift+Ctrl+f1`, `ctrl+shift+f1`)
+	test(`alt+f5`, `alt+f5`)
+	test(`shift+tab`, `shift+tab`)
+	test(`alt+x`, `alt+x`)
+	test(`alt+^C`, `alt+^C`)
+	test(`+`, `+`)
+
+	fail := func(src string) {
+		_, err := parseKey(src)
+		gtest.ErrStr(`invalid hotkey`, err)
+	}
+
+	fail(`f13`)
+	fail(`ctrl+x+y`)
+	fail(`shift+x`)
+	fail(`alt+esc`)
+	fail(`hyper+up`)
+}
+
+func TestHotkeys_Get(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var tar Hotkeys
+	tar.Set(gg.Try1(parseKeyBinding(`home:restart`)))
+	tar.Set(gg.Try1(parseKeyBinding(`f5:clear`)))
+
+	gtest.Eq(tar.Get("\x1b[H").Name, `restart`)
+	gtest.Eq(tar.Get("\x1bOH").Name, `restart`)
+	gtest.Eq(tar.Get("\x1b[1~").Name, `restart`)
+	gtest.Eq(tar.Get("\x1b[15~").Name, `clear`)
+	gtest.Zero(tar.Get("\x1b[15;5~"))
+
+	// Rebinding an alternate sequence replaces the binding.
+	tar.Set(KeyBinding{Key: "\x1b[7~", Action: actionByName(`stop`)})
+	gtest.Len(tar, 2)
+	gtest.Eq(tar.Get("\x1b[H").Name, `stop`)
+
+	help := tar.Help()
+	gtest.TextHas(help, "\t      home        Kill subprocess with SIGTERM. Repeat")
+	gtest.TextHas(help, "\t      f5          Clear terminal.")
+}
+
+func TestStdio_OnKey(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var main Main
+	main.Opt = OptDefault()
+	gtest.NoErr(main.Opt.Keys.Parse(`p:toggle_pause`))
+	gtest.NoErr(main.Opt.Keys.Parse(`v:toggle_verbose`))
+
+	var task Task
+	task.Init(&main, ``, main.Opt)
+	defer task.Deinit()
+	main.Tasks = []*Task{&task}
+
+	var stdio Stdio
+	stdio.Init(&main)
+
+	stdio.OnKey(`p`)
+	gtest.True(main.Paused.Load())
+	gtest.False(task.ShouldRestart(TestFsEvent(filepath.Join(cwd, `one.go`))))
+
+	stdio.OnKey(`p`)
+	gtest.False(main.Paused.Load())
+	gtest.True(task.ShouldRestart(TestFsEvent(filepath.Join(cwd, `one.go`))))
+
+	stdio.OnKey(`v`)
+	gtest.True(main.IsVerb())
+	gtest.True(task.IsVerb())
+
+	stdio.OnKey(`v`)
+	gtest.False(main.IsVerb())
+	gtest.False(task.IsVerb())
+}
+
+func TestMain_SetPaused(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var main Main
+	main.Opt = OptDefault()
+
+	var task Task
+	task.Init(&main, ``, main.Opt)
+	defer task.Deinit()
+	main.Tasks = []*Task{&task}
+
+	one := filepath.Join(cwd, `one.go`)
+	two := filepath.Join(cwd, `two.go`)
+
+	main.SetPaused(true)
+	gtest.False(task.ShouldRestart(TestFsEvent(one)))
+	gtest.False(task.ShouldRestart(TestFsEvent(two)))
+	gtest.False(task.ShouldRestart(TestFsEvent(one)))
+	gtest.False(task.ShouldRestart(testIgnoredEvent()))
+	gtest.Equal(task.Paused.Paths.Slice, []string{one, two})
+
+	// Without `Opt.ResumeRestart`, recorded changes are dropped.
+	main.SetPaused(false)
+	gtest.Zero(task.Paused.Paths.Slice)
+	gtest.Zero(task.Pending.Paths.Slice)
+	gtest.True(task.ShouldRestart(TestFsEvent(one)))
+
+	task.Opt.ResumeRestart = true
+	main.SetPaused(true)
+	main.SetPaused(true)
+	gtest.False(task.ShouldRestart(TestFsEvent(two)))
+
+	main.SetPaused(false)
+	gtest.Zero(task.Paused.Paths.Slice)
+	paths, manual := task.Pending.Take()
+	gtest.Equal(paths, []string{two})
+	gtest.False(manual)
+
+	// Nothing changed while paused: no restart.
+	main.SetPaused(true)
+	main.SetPaused(false)
+	gtest.Zero(task.Pending.Paths.Slice)
+}
+
 func TestFlagIgnoreDirs_Ignore(t *testing.T) {
 	defer gtest.Catch(t)
 
@@ -147,20 +2079,24 @@ func TestFlagIgnoreDirs_Ignore(t *testing.T) {
 }
 
 func BenchmarkOpt_AllowPath(b *testing.B) {
-	gtest.False(testOpt.AllowPath(testIgnoredPath))
+	opt := testOpt()
+	path := testIgnoredPath()
+	gtest.False(opt.AllowPath(path))
 	b.ResetTimer()
 
 	for ind := 0; ind < b.N; ind++ {
-		testOpt.AllowPath(testIgnoredPath)
+		opt.AllowPath(path)
 	}
 }
 
-func BenchmarkMain_ShouldRestart(b *testing.B) {
-	gtest.False(testMain.ShouldRestart(testIgnoredEvent))
+func BenchmarkTask_ShouldRestart(b *testing.B) {
+	task := Task{Opt: testOpt()}
+	event := testIgnoredEvent()
+	gtest.False(task.ShouldRestart(event))
 	b.ResetTimer()
 
 	for ind := 0; ind < b.N; ind++ {
-		testMain.ShouldRestart(testIgnoredEvent)
+		task.ShouldRestart(event)
 	}
 }
 
@@ -1,48 +1,157 @@
 package main
 
 import (
+	"errors"
 	"path/filepath"
+	"sync"
+	"syscall"
 
 	"github.com/mitranim/gg"
 	"github.com/rjeczalik/notify"
 )
 
-// Implementation of `Watcher` that uses "github.com/rjeczalik/notify".
+/*
+Implementation of `Watcher` that uses "github.com/rjeczalik/notify".
+
+When native watches can't be created because of OS limits, which is common
+with inotify in large repositories, the affected directories are watched by a
+nested `WatchPoll` instead of failing. Polling covers the entire tree of each
+failed directory from `Main.WatchDirs`, not only its unwatched subdirectories:
+the library doesn't report which subdirectories were watched, and removes
+watches only by channel. Once the limit is reached, other subdirectories would
+fail too. Ignored directories are skipped, and narrower "-w" directories make
+the polled trees smaller.
+
+`.Lock` guards the watches and the nested poller, which are replaced by
+`WatchNotify.Sync`.
+*/
 type WatchNotify struct {
 	Mained
-	Done   gg.Chan[struct{}]
-	Events gg.Chan[notify.EventInfo]
+	Lock    sync.Mutex
+	Done    gg.Chan[struct{}]
+	Events  gg.Chan[notify.EventInfo]
+	Dirs    []string
+	Poll    *WatchPoll
+	Running bool
+	Closed  bool
 }
 
 func (self *WatchNotify) Init(main *Main) {
 	self.Mained.Init(main)
 	self.Done.Init()
 	self.Events.InitCap(1)
+	self.WatchAll(main.WatchDirs())
+}
+
+/*
+Watches the given directories, falling back on polling for those which exceed
+the OS limit on watches. Must be called under `.Lock`, or before `.Run`.
+*/
+func (self *WatchNotify) WatchAll(paths []string) {
+	main := self.Main()
+	var fallback []string
+
+	/**
+	A recursive watch which fails midway leaves watches on some of the
+	subdirectories. Polling the directory on top of that would report the same
+	changes twice. The library removes watches only by channel, so we remove
+	all of them, and watch the other directories again.
+	*/
+	for {
+		path, err := self.Watch(gg.Exclude(paths, fallback...))
+		if err == nil {
+			break
+		}
+		notify.Stop(self.Events)
 
-	paths := main.Opt.WatchDirs
-	verb := main.Opt.Verb && !gg.Equal(paths, OptDefault().WatchDirs)
+		log.Printf(
+			`unable to watch %q via native FS events: %v; the OS limit on watches is likely exhausted; to raise it on Linux, run "sudo sysctl %v=<larger_number>"; falling back on polling its entire tree every %v, which may be slow for large trees; to poll less, ignore large directories via "-i", or watch narrower directories via "-w"`,
+			path, err, watchLimitSysctl(err), main.Opt.PollDelay,
+		)
+		fallback = append(fallback, path)
+	}
 
+	if main.IsVerb() && !gg.Equal(paths, []string(OptDefault().WatchDirs)) {
+		for _, path := range gg.Exclude(paths, fallback...) {
+			log.Printf(`watching %q`, filepath.Join(path, `...`))
+		}
+	}
+
+	self.Dirs = paths
+	if gg.IsNotEmpty(fallback) {
+		self.Poll = &WatchPoll{Dirs: fallback}
+		self.Poll.Init(main)
+	}
+}
+
+/*
+The library removes watches only by channel, so we remove all of them, and
+watch all directories again. Changes made in the meantime may be missed.
+*/
+func (self *WatchNotify) Sync() {
+	paths := self.Main().WatchDirs()
+	defer gg.Lock(&self.Lock).Unlock()
+
+	if self.Closed || gg.Equal(paths, self.Dirs) {
+		return
+	}
+
+	notify.Stop(self.Events)
+	if self.Poll != nil {
+		self.Poll.Deinit()
+		self.Poll = nil
+	}
+
+	self.WatchAll(paths)
+	if self.Poll != nil && self.Running {
+		go self.Poll.Run()
+	}
+}
+
+/*
+Watches the given directories recursively. On reaching the OS limit on
+watches, returns the failed directory. Other errors are fatal.
+*/
+func (self *WatchNotify) Watch(paths []string) (string, error) {
 	for _, path := range paths {
 		// In "github.com/rjeczalik/notify", the "..." syntax is used to signify
 		// recursive watching.
-		path = filepath.Join(path, `...`)
-		if verb {
-			log.Printf(`watching %q`, path)
+		rec := filepath.Join(path, `...`)
+
+		err := notifyWatch(rec, self.Events, notify.All)
+		if err == nil {
+			continue
 		}
-		gg.Try(notify.Watch(path, self.Events, notify.All))
+		if !isWatchLimitErr(err) {
+			panic(gg.Wrapf(err, `unable to watch %q`, rec))
+		}
+		return path, err
 	}
+	return ``, nil
 }
 
 func (self *WatchNotify) Deinit() {
+	defer gg.Lock(&self.Lock).Unlock()
+	self.Closed = true
 	self.Done.SendZeroOpt()
 	if self.Events != nil {
 		notify.Stop(self.Events)
 	}
+	if self.Poll != nil {
+		self.Poll.Deinit()
+	}
 }
 
-func (self WatchNotify) Run() {
+func (self *WatchNotify) Run() {
 	main := self.Main()
 
+	self.Lock.Lock()
+	self.Running = true
+	if self.Poll != nil {
+		go self.Poll.Run()
+	}
+	self.Lock.Unlock()
+
 	for {
 		select {
 		case <-self.Done:
@@ -52,3 +161,21 @@ func (self WatchNotify) Run() {
 		}
 	}
 }
+
+// Replaced in tests, which can't exhaust the OS limits.
+var notifyWatch = notify.Watch
+
+/*
+Inotify reports `ENOSPC` when "fs.inotify.max_user_watches" is exhausted, and
+`EMFILE` when "fs.inotify.max_user_instances" is exhausted.
+*/
+func isWatchLimitErr(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+func watchLimitSysctl(err error) string {
+	if errors.Is(err, syscall.EMFILE) {
+		return `fs.inotify.max_user_instances`
+	}
+	return `fs.inotify.max_user_watches`
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Implementation of `Watcher` that periodically walks the watched directories
+and compares file modification times and sizes. Slower and less precise than
+`WatchNotify`, but works where native FS events are unavailable or unreliable:
+bind-mounted directories in containers, network filesystems, FUSE mounts.
+
+Ignored directories are skipped during the walk, and only allowed files are
+remembered, which keeps the cost of each scan proportional to the amount of
+files we actually care about.
+
+When `.Dirs` is provided by the caller, as by `WatchNotify`, it's fixed.
+Otherwise it's `Main.WatchDirs`, and `WatchPoll.Sync` makes `.Run` switch to
+the new directories.
+*/
+type WatchPoll struct {
+	Mained
+	Dirs   []string
+	Done   gg.Chan[struct{}]
+	Resync gg.Chan[struct{}]
+	State  map[string]PollStat
+}
+
+func (self *WatchPoll) Init(main *Main) {
+	self.Mained.Init(main)
+	self.Done.Init()
+	self.Resync.InitCap(1)
+
+	if self.Dirs == nil {
+		self.Dirs = main.WatchDirs()
+	}
+	self.LogDirs()
+	self.State = self.Walk()
+}
+
+func (self *WatchPoll) LogDirs() {
+	main := self.Main()
+	if !main.IsVerb() || gg.Equal(self.Dirs, []string(OptDefault().WatchDirs)) {
+		return
+	}
+	for _, path := range self.Dirs {
+		log.Printf(`polling %q every %v`, path, main.Opt.PollDelay)
+	}
+}
+
+func (self *WatchPoll) Deinit() { self.Done.SendZeroOpt() }
+
+func (self *WatchPoll) Sync() { self.Resync.SendZeroOpt() }
+
+func (self *WatchPoll) Run() {
+	main := self.Main()
+	ticker := time.NewTicker(main.Opt.PollDelay.Duration())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.Done:
+			return
+		case <-ticker.C:
+			self.Tick()
+		case <-self.Resync:
+			// Reports the changes in the previous directories first.
+			self.Tick()
+			dirs := main.WatchDirs()
+			if !gg.Equal(dirs, self.Dirs) {
+				self.Dirs = dirs
+				self.LogDirs()
+				self.State = self.Walk()
+			}
+		}
+	}
+}
+
+func (self *WatchPoll) Tick() {
+	main := self.Main()
+	next := self.Walk()
+	for _, event := range pollDiff(self.State, next) {
+		main.OnFsEvent(event)
+	}
+	self.State = next
+}
+
+// Returns the current state of all allowed files in the watched directories.
+func (self *WatchPoll) Walk() map[string]PollStat {
+	main := self.Main()
+	out := map[string]PollStat{}
+
+	for _, dir := range self.Dirs {
+		dir = toAbsPath(dir)
+		if !main.AllowDir(dir) {
+			continue
+		}
+
+		gg.Nop1(filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			// Unreadable entries may be transient: files removed mid-walk,
+			// permission changes, and so on. We simply skip them.
+			if err != nil {
+				return nil
+			}
+
+			if entry.IsDir() {
+				if path != dir && !main.AllowDir(path) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Ignore files are tracked regardless of filters, so that changes in
+			// ignore rules are noticed by `Main.OnFsEvent`.
+			if !main.AllowPath(path) && !isIgnoreFile(path) {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			out[path] = PollStat{ModTime: info.ModTime(), Size: info.Size()}
+			return nil
+		}))
+	}
+	return out
+}
+
+type PollStat struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// Implementation of `FsEvent` used by `WatchPoll`.
+type PollEvent struct {
+	Op   string
+	File string
+}
+
+func (self PollEvent) Path() string { return self.File }
+
+func (self PollEvent) String() string {
+	return self.Op + `: ` + strconv.Quote(self.File)
+}
+
+func pollDiff(prev, next map[string]PollStat) (out []PollEvent) {
+	for path, stat := range next {
+		old, ok := prev[path]
+		if !ok {
+			out = append(out, PollEvent{`create`, path})
+		} else if !old.ModTime.Equal(stat.ModTime) || old.Size != stat.Size {
+			out = append(out, PollEvent{`write`, path})
+		}
+	}
+	for path := range prev {
+		if !gg.MapHas(next, path) {
+			out = append(out, PollEvent{`remove`, path})
+		}
+	}
+	return
+}